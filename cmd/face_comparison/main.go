@@ -10,10 +10,15 @@ import (
 	"time"
 
 	internalApp "github.com/spendmail/face_comparison/internal/app"
+	internalAuth "github.com/spendmail/face_comparison/internal/auth"
 	awsClient "github.com/spendmail/face_comparison/internal/aws"
 	internalConfig "github.com/spendmail/face_comparison/internal/config"
+	internalJobs "github.com/spendmail/face_comparison/internal/jobs"
 	internalLogger "github.com/spendmail/face_comparison/internal/logger"
+	internalQuota "github.com/spendmail/face_comparison/internal/quota"
+	internalReview "github.com/spendmail/face_comparison/internal/review"
 	internalServer "github.com/spendmail/face_comparison/internal/server/http"
+	internalWebhook "github.com/spendmail/face_comparison/internal/webhook"
 )
 
 var configPath string
@@ -40,17 +45,56 @@ func main() {
 		log.Fatal(err)
 	}
 
-	recognitionClient, err := awsClient.NewRecognitionClient(config, logger)
+	// The limiter is waited on before every backend call, the retried ones included.
+	rateLimiter := internalApp.NewRateLimiter(config)
+
+	recognitionClient, err := awsClient.NewRecognitionClient(config, logger, rateLimiter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reviewStore, err := internalReview.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	breakerClient := internalApp.NewBreakerClient(config, recognitionClient)
+
+	app, err := internalApp.New(logger, config, breakerClient, reviewStore)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	app, err := internalApp.New(logger, config, recognitionClient)
+	authenticator, err := internalAuth.New(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := internalServer.New(config, logger, app)
+	limiter, err := internalQuota.New(config, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The callbacks are kept away from the internal addresses by the webhook lists of their own.
+	guard, err := internalWebhook.NewGuard(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outbox, err := internalWebhook.New(config, logger, guard)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Callback urls are refused unless the payloads can be signed.
+	var notifier internalJobs.Notifier
+	if outbox.Enabled() {
+		notifier = internalServer.NewJobNotifier(outbox, logger)
+	}
+
+	jobManager := internalJobs.New(config, app, notifier)
+
+	server := internalServer.New(config, logger, app, reviewStore, breakerClient, authenticator, limiter, jobManager, guard)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -75,6 +119,32 @@ func main() {
 		}
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// Dumping the daily quotas until the server is stopped.
+		if err := limiter.Run(ctx); err != nil {
+			logger.Error(err.Error())
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// Running the background jobs until the server is stopped.
+		jobManager.Run(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// Delivering the job callbacks until the server is stopped.
+		outbox.Run(ctx)
+	}()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spendmail/face_comparison/internal/face"
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+// AnalysisResult is an outcome of analyzing a single image, Faces are empty if the analysis failed.
+type AnalysisResult struct {
+	URL   string
+	Faces []face.Details
+	Code  string
+	Err   error
+}
+
+// AnalyzeImage downloads the image and returns the attributes of every face found on it.
+// The download and the backend call share the process-wide limits with the comparisons.
+func (app *Application) AnalyzeImage(ctx context.Context, url string) AnalysisResult {
+	result := AnalysisResult{URL: url, Faces: make([]face.Details, 0)}
+
+	image := app.downloadImage(ctx, limiter{global: app.downloads}, url)
+	if image.err != nil {
+		result.Code, result.Err = ErrorCode(image.err), image.err
+		return result
+	}
+
+	if err := app.comparisons.acquire(ctx); err != nil {
+		result.Code, result.Err = CodeCanceled, err
+		return result
+	}
+	defer app.comparisons.release()
+
+	faces, err := app.RecognitionClient.AnalyzeFaces(ctx, image.bytes)
+
+	if err != nil && ctx.Err() != nil {
+		result.Code, result.Err = CodeCanceled, wrap.New(ErrCanceled, ctx.Err())
+		return result
+	}
+
+	if err != nil {
+		result.Code, result.Err = backendCode(err), fmt.Errorf("unable to analyze image %s: %w", url, err)
+		return result
+	}
+
+	result.Faces = faces
+
+	return result
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeImage(t *testing.T) {
+	server := newImageServer()
+	defer server.Close()
+
+	app, err := New(nopLogger{}, fakeConfig{}, fakeRecognitionClient{}, nil)
+	require.NoError(t, err)
+
+	t.Run("every face", func(t *testing.T) {
+		result := app.AnalyzeImage(context.Background(), server.URL+"/0/alice,bob")
+		require.NoError(t, result.Err)
+		require.Empty(t, result.Code)
+		require.Len(t, result.Faces, 2)
+		require.True(t, result.Faces[0].Smile.Value)
+	})
+
+	t.Run("no faces", func(t *testing.T) {
+		result := app.AnalyzeImage(context.Background(), server.URL+"/0/")
+		require.NoError(t, result.Err)
+		require.NotNil(t, result.Faces)
+		require.Empty(t, result.Faces)
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		result := app.AnalyzeImage(context.Background(), server.URL+"/text")
+		require.ErrorIs(t, result.Err, ErrFileNotSupported)
+		require.Equal(t, CodeUnsupportedType, result.Code)
+		require.Empty(t, result.Faces)
+	})
+
+	t.Run("backend error", func(t *testing.T) {
+		result := app.AnalyzeImage(context.Background(), server.URL+"/0/error")
+		require.Error(t, result.Err)
+		require.Equal(t, CodeBackendError, result.Code)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		result := app.AnalyzeImage(ctx, server.URL+"/200/alice")
+		require.Error(t, result.Err)
+		require.NotEqual(t, CodeInternalError, result.Code)
+	})
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
 	"sync"
+
+	"github.com/spendmail/face_comparison/internal/face"
+	"github.com/spendmail/face_comparison/internal/review"
+	"github.com/spendmail/face_comparison/internal/wrap"
 )
 
 type Logger interface {
@@ -18,22 +20,62 @@ type Logger interface {
 }
 
 type Config interface {
+	DownloaderConfig
+	GetSimilarityThreshold() float64
+	GetBorderlineThreshold() float64
+	GetDownloadWorkers() int
+	GetDownloadRequestWorkers() int
+	GetCompareWorkers() int
+	GetCompareRequestWorkers() int
 }
 
 type RecognitionClient interface {
-	CompareFaces(source, target []byte) (int, int, error)
-	PredictGender(source []byte) (string, error)
+	CompareFaces(ctx context.Context, source, target []byte) (face.Comparison, error)
+	PredictGender(ctx context.Context, source []byte) (string, error)
+	AnalyzeFaces(ctx context.Context, source []byte) ([]face.Details, error)
+}
+
+// ReviewStore keeps borderline comparisons for a manual review.
+type ReviewStore interface {
+	Add(reference, target string, similarity float64) (review.Item, error)
 }
 
 type Application struct {
 	Logger            Logger
 	Config            Config
 	RecognitionClient RecognitionClient
+	ReviewStore       ReviewStore
+	Downloader        *Downloader
+
+	// process-wide limits shared by all the comparisons
+	downloads   semaphore
+	comparisons semaphore
 }
 
 type ImagePair struct {
 	url   string
 	bytes []byte
+	err   error
+}
+
+// ComparisonResult is an outcome of comparing the reference image with the targets.
+// Targets are kept in the order they were passed to CompareImages.
+type ComparisonResult struct {
+	Reference ImageResult
+	Targets   []ImageResult
+	Gender    string
+	Errors    []error
+}
+
+// ImageResult is an outcome of processing a single image of the comparison.
+type ImageResult struct {
+	URL        string
+	Status     Status
+	Similarity float64
+	Comparison *face.Comparison
+	Attempts   int
+	Code       string
+	Err        error
 }
 
 const (
@@ -48,226 +90,266 @@ var (
 	ErrFileRead         = errors.New("unable to read a file")
 	ErrFileNotSupported = errors.New("unsupported file type")
 	ErrNotEnoughImage   = errors.New("not enough images to compare")
+	ErrCanceled         = errors.New("comparison canceled")
+	ErrHTTPStatus       = errors.New("unexpected http status")
+	ErrTooLarge         = errors.New("file is too large")
+	ErrTimeout          = errors.New("download timed out")
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrBlocked          = errors.New("url is blocked")
+	ErrWrongNetwork     = errors.New("wrong network")
+	ErrRateLimited      = errors.New("recognition rate limit exceeded")
+	ErrBreakerOpen      = errors.New("recognition backend is unavailable")
 )
 
-func New(logger Logger, config Config, recognitionClient RecognitionClient) (*Application, error) {
+func New(logger Logger, config Config, recognitionClient RecognitionClient, reviewStore ReviewStore) (*Application, error) {
+	downloader, err := NewDownloader(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Application{
 		Logger:            logger,
 		Config:            config,
 		RecognitionClient: recognitionClient,
+		ReviewStore:       reviewStore,
+		Downloader:        downloader,
+		downloads:         newSemaphore(config.GetDownloadWorkers()),
+		comparisons:       newSemaphore(config.GetCompareWorkers()),
 	}, nil
 }
 
-func (app *Application) CompareImages(urls []string) (string, []string, []string, []string, string, []error) {
+// Options tune a single comparison.
+type Options struct {
+	// SkipGender leaves the reference gender empty without calling the backend.
+	SkipGender bool
+	// OnTarget is called with every target as soon as its outcome is known, i is its index in the targets.
+	// The calls are made one at a time and all of them before CompareImages returns.
+	OnTarget func(i int, target ImageResult)
+}
+
+// report returns the serialized OnTarget callback, or a no-op one if it isn't set.
+func (o Options) report() func(i int, target ImageResult) {
+	if o.OnTarget == nil {
+		return func(int, ImageResult) {}
+	}
 
-	urlsCnt := len(urls)
+	mu := sync.Mutex{}
 
-	// not enough photos
-	if urlsCnt < 2 {
-		return "", []string{}, []string{}, []string{}, "", []error{ErrNotEnoughImage}
+	return func(i int, target ImageResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		o.OnTarget(i, target)
+	}
+}
+
+// CompareImages compares every target with the reference image.
+// Downloads start at once, every target is compared as soon as both it and the reference are downloaded,
+// while the reference gender is predicted alongside the comparisons.
+// Once ctx is done, downloads and comparisons in progress are abandoned and the rest of targets are skipped.
+func (app *Application) CompareImages(ctx context.Context, reference string, targets []string, options Options) ComparisonResult {
+
+	result := ComparisonResult{
+		Reference: ImageResult{URL: reference, Status: StatusSkipped, Code: CodeNotEnoughImages},
+		Targets:   make([]ImageResult, len(targets)),
+		Errors:    make([]error, 0),
 	}
 
-	unmatched := make([]string, 0, urlsCnt)
-	multipleFaces := make([]string, 0, urlsCnt)
-	facesNotFound := make([]string, 0, urlsCnt)
+	for i, url := range targets {
+		result.Targets[i] = ImageResult{URL: url, Status: StatusSkipped, Code: CodeNotEnoughImages}
+	}
 
-	// downloading images
-	//imagesBytes, errs := app.downloadImagesByUrls(urls)
-	imagesBytes, errs := app.downloadImagesByUrlsWithChannels(urls)
+	report := options.report()
 
-	// not enough photos after filtering
-	if len(imagesBytes) < 2 {
-		errs = append(errs, fmt.Errorf("%w: some of the images were probably filtered", ErrNotEnoughImage))
-		return "", []string{}, []string{}, []string{}, "", errs
+	// not enough photos
+	if reference == "" || len(targets) == 0 {
+		for i, t := range result.Targets {
+			report(i, t)
+		}
+		result.Errors = append(result.Errors, ErrNotEnoughImage)
+		return result
 	}
 
-	source := imagesBytes[0]
-	targets := imagesBytes[1:]
+	downloads := limiter{newSemaphore(app.Config.GetDownloadRequestWorkers()), app.downloads}
+	comparisons := limiter{newSemaphore(app.Config.GetCompareRequestWorkers()), app.comparisons}
 
-	cnt := len(targets)
-	unmatchedChan := make(chan string, cnt)
-	multipleFacesChan := make(chan string, cnt)
-	facesNotFoundChan := make(chan string, cnt)
-	errsChan := make(chan error, cnt)
+	// the reference image is shared by all the targets, it's safe to read once sourceReady is closed
+	var source ImagePair
+	sourceReady := make(chan struct{})
+	go func() {
+		defer close(sourceReady)
+		source = app.downloadImage(ctx, downloads, reference)
+	}()
+
+	var gender string
+	var genderErr error
+	downloadErrs := make([]error, len(targets))
+	compareErrs := make([]error, len(targets))
 
 	wg := sync.WaitGroup{}
 
-	// faces comparison
-	for _, target := range targets {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-sourceReady
+		if source.err != nil || options.SkipGender {
+			return
+		}
+
+		gender, genderErr = app.predictGender(ctx, source.bytes)
+	}()
+
+	// every goroutine owns its own slot of the result
+	for i := range targets {
 		wg.Add(1)
-		go func(p ImagePair) {
+		go func(i int, t *ImageResult) {
 			defer wg.Done()
-			unmatchedCnt, matchedCnt, err := app.RecognitionClient.CompareFaces(source.bytes, p.bytes)
-
-			if unmatchedCnt == 1 {
-				unmatchedChan <- p.url
-			} else if unmatchedCnt > 1 {
-				multipleFacesChan <- p.url
+			defer func() {
+				report(i, *t)
+			}()
+
+			target := app.downloadImage(ctx, downloads, t.URL)
+			if target.err != nil {
+				t.fail(downloadStatus(target.err), ErrorCode(target.err), target.err)
+				downloadErrs[i] = target.err
+				return
 			}
 
-			if unmatchedCnt == 0 && matchedCnt == 0 {
-				facesNotFoundChan <- p.url
+			<-sourceReady
+			if source.err != nil {
+				return
 			}
 
-			if err != nil {
-				e := fmt.Errorf("unable to compare images %s and %s: %w", source.url, p.url, err)
-				errsChan <- e
-			}
-		}(target)
+			compareErrs[i] = app.compareTarget(ctx, comparisons, source, target, t)
+		}(i, &result.Targets[i])
 	}
 
 	wg.Wait()
 
-	close(unmatchedChan)
-	close(multipleFacesChan)
-	close(facesNotFoundChan)
-	close(errsChan)
-
-	for {
-		val, ok := <-unmatchedChan
-		if !ok {
-			break
-		}
-		unmatched = append(unmatched, val)
+	if source.err != nil {
+		result.Reference.fail(downloadStatus(source.err), ErrorCode(source.err), source.err)
+		result.Errors = append(result.Errors, source.err)
+	} else {
+		result.Reference.Status = StatusReference
+		result.Reference.Code = ""
 	}
 
-	for {
-		val, ok := <-multipleFacesChan
-		if !ok {
-			break
+	available := 0
+	for _, err := range downloadErrs {
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
 		}
-		multipleFaces = append(multipleFaces, val)
+		available++
 	}
 
-	for {
-		val, ok := <-facesNotFoundChan
-		if !ok {
-			break
-		}
-		facesNotFound = append(facesNotFound, val)
+	// not enough photos after filtering
+	if source.err != nil || available == 0 {
+		result.Errors = append(result.Errors, fmt.Errorf("%w: some of the images were probably filtered", ErrNotEnoughImage))
+		return result
 	}
 
-	for {
-		val, ok := <-errsChan
-		if !ok {
-			break
+	for _, err := range compareErrs {
+		if err != nil {
+			result.Errors = append(result.Errors, err)
 		}
-		errs = append(errs, val)
 	}
 
-	gender, err := app.RecognitionClient.PredictGender(source.bytes)
-	if err != nil {
-		errs = append(errs, fmt.Errorf("%s: %w", source.url, err))
-	}
+	app.sendToReview(result)
 
-	return source.url, unmatched, multipleFaces, facesNotFound, gender, errs
-}
-
-func (app *Application) downloadImagesByUrls(urls []string) ([]ImagePair, []error) {
-
-	imagePairs := make([]ImagePair, 0, len(urls))
-	errs := make([]error, 0, len(imagePairs))
+	if err := ctx.Err(); err != nil {
+		result.Errors = append(result.Errors, wrap.New(ErrCanceled, err))
+		return result
+	}
 
-	for _, url := range urls {
-		imageBytes, err := app.downloadByURL(url)
+	if genderErr != nil {
+		result.Errors = append(result.Errors, fmt.Errorf("%s: %w", source.url, genderErr))
+	}
 
-		if err != nil {
-			errs = append(errs, err)
-			continue
-		}
+	result.Gender = gender
 
-		err = app.extensionValidate(imageBytes)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("%w: %s", err, url))
-			continue
-		}
+	return result
+}
 
-		imagePairs = append(imagePairs, ImagePair{url, imageBytes})
+// compareTarget fills t with the comparison outcome, the returned error is the one to be reported to a client.
+func (app *Application) compareTarget(ctx context.Context, comparisons limiter, source, target ImagePair, t *ImageResult) error {
+	if err := comparisons.acquire(ctx); err != nil {
+		t.fail(StatusSkipped, CodeCanceled, err)
+		return nil
 	}
+	defer comparisons.release()
 
-	return imagePairs, errs
-}
-
-func (app *Application) downloadImagesByUrlsWithChannels(urls []string) ([]ImagePair, []error) {
+	comparison, err := app.RecognitionClient.CompareFaces(ctx, source.bytes, target.bytes)
+	t.Attempts = comparison.Attempts
 
-	urlsLen := len(urls)
-	imagePairs := make([]ImagePair, 0, urlsLen)
-	errs := make([]error, 0, urlsLen)
-	var wg sync.WaitGroup
+	if err != nil && ctx.Err() != nil {
+		t.fail(StatusSkipped, CodeCanceled, wrap.New(ErrCanceled, ctx.Err()))
+		return nil
+	}
 
-	errsChan := make(chan error, urlsLen)
-	pairsChan := make(chan ImagePair, urlsLen)
+	if err != nil {
+		e := fmt.Errorf("unable to compare images %s and %s: %w", source.url, target.url, err)
+		t.fail(backendStatus(err), backendCode(err), e)
+		return e
+	}
 
-	for _, url := range urls {
+	// the backend reports raw similarities, the threshold is applied locally
+	comparison = comparison.WithThreshold(app.Config.GetSimilarityThreshold())
 
-		wg.Add(1)
-		go func(url string) {
-			defer wg.Done()
+	t.Comparison = &comparison
+	t.Similarity = comparison.Similarity()
+	t.Status = comparisonStatus(comparison, app.Config.GetBorderlineThreshold())
+	t.Code = ""
 
-			imageBytes, err := app.downloadByURL(url)
+	return nil
+}
 
-			if err != nil {
-				errsChan <- err
-				return
-			}
+// predictGender shares the process-wide limit with the comparisons, since it's a call to the same backend.
+func (app *Application) predictGender(ctx context.Context, source []byte) (string, error) {
+	if err := app.comparisons.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer app.comparisons.release()
 
-			err = app.extensionValidate(imageBytes)
-			if err != nil {
-				errsChan <- fmt.Errorf("%w: %s", err, url)
-				return
-			}
+	return app.RecognitionClient.PredictGender(ctx, source)
+}
 
-			pairsChan <- ImagePair{url, imageBytes}
-		}(url)
+// sendToReview puts borderline targets to the review store, failures don't affect the comparison.
+func (app *Application) sendToReview(result ComparisonResult) {
+	if app.ReviewStore == nil {
+		return
 	}
 
-	wg.Wait()
-	close(errsChan)
-	close(pairsChan)
-
-	for {
-		e, ok := <-errsChan
-		if !ok {
-			break
+	for _, target := range result.Targets {
+		if target.Status != StatusBorderline {
+			continue
 		}
-		errs = append(errs, e)
-	}
 
-	for {
-		pair, ok := <-pairsChan
-		if !ok {
-			break
+		if _, err := app.ReviewStore.Add(result.Reference.URL, target.URL, target.Similarity); err != nil {
+			app.Logger.Error(fmt.Errorf("unable to send %s to review: %w", target.URL, err))
 		}
-		imagePairs = append(imagePairs, pair)
 	}
-
-	return imagePairs, errs
 }
 
-func (app *Application) downloadByURL(url string) ([]byte, error) {
-	request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
-	if err != nil {
-		return []byte{}, fmt.Errorf("%w: %s", ErrRequest, err)
+// downloadImage downloads and validates a single image, as soon as the limiter allows.
+func (app *Application) downloadImage(ctx context.Context, downloads limiter, url string) ImagePair {
+	if err := downloads.acquire(ctx); err != nil {
+		return ImagePair{url: url, err: err}
 	}
+	defer downloads.release()
 
-	response, err := http.DefaultClient.Do(request)
+	imageBytes, err := app.Downloader.Download(ctx, url)
 	if err != nil {
-		// Identifying wrong domain name errors.
-		var DNSError *net.DNSError
-		if errors.As(err, &DNSError) {
-			return []byte{}, fmt.Errorf("%w: %s", ErrServerNotExists, err)
-		}
-
-		return []byte{}, fmt.Errorf("%w: %s", ErrDownload, err)
+		return ImagePair{url: url, err: err}
 	}
-	defer response.Body.Close()
 
-	responseBytes, err := io.ReadAll(response.Body)
+	err = app.extensionValidate(imageBytes)
 	if err != nil {
-		return []byte{}, fmt.Errorf("%w: %s", ErrFileRead, err)
+		return ImagePair{url: url, err: fmt.Errorf("%w: %s", err, url)}
 	}
 
-	return responseBytes, nil
+	return ImagePair{url: url, bytes: imageBytes}
 }
 
 func (app *Application) extensionValidate(imageBytes []byte) error {
@@ -280,3 +362,45 @@ func (app *Application) extensionValidate(imageBytes []byte) error {
 
 	return nil
 }
+
+func (r *ImageResult) fail(status Status, code string, err error) {
+	r.Status = status
+	r.Code = code
+	r.Err = err
+}
+
+// Images returns the reference image followed by the targets.
+func (r ComparisonResult) Images() []ImageResult {
+	return append([]ImageResult{r.Reference}, r.Targets...)
+}
+
+// Unmatched returns targets containing a single face which doesn't match the reference one.
+func (r ComparisonResult) Unmatched() []string {
+	return r.filter(StatusUnmatched)
+}
+
+// Borderline returns targets containing a single face which similarity is within the gray zone.
+func (r ComparisonResult) Borderline() []string {
+	return r.filter(StatusBorderline)
+}
+
+// MultipleFaces returns targets containing more than one unmatched face.
+func (r ComparisonResult) MultipleFaces() []string {
+	return r.filter(StatusMultipleFaces)
+}
+
+// FacesNotFound returns targets without any face found.
+func (r ComparisonResult) FacesNotFound() []string {
+	return r.filter(StatusNoFace)
+}
+
+func (r ComparisonResult) filter(status Status) []string {
+	urls := make([]string, 0, len(r.Targets))
+	for _, t := range r.Targets {
+		if t.Status == status {
+			urls = append(urls, t.URL)
+		}
+	}
+
+	return urls
+}
@@ -0,0 +1,233 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	awsClient "github.com/spendmail/face_comparison/internal/aws"
+	"github.com/spendmail/face_comparison/internal/face"
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+type BreakerConfig interface {
+	GetBreakerFailureRate() float64
+	GetBreakerWindow() int
+	GetBreakerMinRequests() int
+	GetBreakerOpenTimeout() time.Duration
+	GetBreakerHalfOpenRequests() int
+}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeIgnored is a call which says nothing about the backend health, e.g. canceled by a client.
+	outcomeIgnored
+)
+
+// BreakerClient stops calling the backend while it's degraded.
+// It trips once the failure rate among the last window calls reaches the configured one,
+// then fails fast for the open timeout, then lets a few probe calls through in the half-open state.
+// The breaker closes again if all the probes succeed, otherwise it opens for another timeout.
+type BreakerClient struct {
+	client RecognitionClient
+	config BreakerConfig
+
+	mu    sync.Mutex
+	state string
+	// generation changes with every state transition, so late results of older calls are ignored
+	generation uint64
+	window     []bool
+	next       int
+	calls      int
+	failures   int
+	openedAt   time.Time
+	probes     int
+	successes  int
+}
+
+func NewBreakerClient(config BreakerConfig, client RecognitionClient) *BreakerClient {
+	window := config.GetBreakerWindow()
+	if window < 1 {
+		window = 1
+	}
+
+	return &BreakerClient{
+		client: client,
+		config: config,
+		state:  BreakerClosed,
+		window: make([]bool, window),
+	}
+}
+
+func (b *BreakerClient) CompareFaces(ctx context.Context, source, target []byte) (face.Comparison, error) {
+	generation, err := b.allow()
+	if err != nil {
+		return face.Comparison{}, err
+	}
+
+	comparison, err := b.client.CompareFaces(ctx, source, target)
+	b.done(generation, b.outcome(ctx, err))
+
+	return comparison, err
+}
+
+func (b *BreakerClient) PredictGender(ctx context.Context, source []byte) (string, error) {
+	generation, err := b.allow()
+	if err != nil {
+		return "", err
+	}
+
+	gender, err := b.client.PredictGender(ctx, source)
+	b.done(generation, b.outcome(ctx, err))
+
+	return gender, err
+}
+
+func (b *BreakerClient) AnalyzeFaces(ctx context.Context, source []byte) ([]face.Details, error) {
+	generation, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	faces, err := b.client.AnalyzeFaces(ctx, source)
+	b.done(generation, b.outcome(ctx, err))
+
+	return faces, err
+}
+
+// State returns the current breaker state, an open breaker past its timeout is reported as half-open.
+func (b *BreakerClient) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.config.GetBreakerOpenTimeout() {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+func (b *BreakerClient) outcome(ctx context.Context, err error) outcome {
+	switch {
+	case err == nil, awsClient.IsClientError(err):
+		// the backend is fine, it's the images that are wrong
+		return outcomeSuccess
+	case ctx.Err() != nil, errors.Is(err, ErrRateLimited):
+		return outcomeIgnored
+	default:
+		return outcomeFailure
+	}
+}
+
+// allow returns the generation the call belongs to, or an error if the call isn't allowed.
+func (b *BreakerClient) allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.config.GetBreakerOpenTimeout() {
+			retryAt := b.openedAt.Add(b.config.GetBreakerOpenTimeout()).Format(time.RFC3339)
+			return 0, wrap.New(ErrBreakerOpen, fmt.Errorf("%w: retrying after %s", awsClient.ErrBackendUnavailable, retryAt))
+		}
+
+		b.transit(BreakerHalfOpen)
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.halfOpenRequests() {
+			return 0, wrap.New(ErrBreakerOpen, fmt.Errorf("%w: probing the backend", awsClient.ErrBackendUnavailable))
+		}
+		b.probes++
+	}
+
+	return b.generation, nil
+}
+
+func (b *BreakerClient) done(generation uint64, o outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		switch o {
+		case outcomeFailure:
+			b.open()
+		case outcomeSuccess:
+			b.successes++
+			if b.successes >= b.halfOpenRequests() {
+				b.transit(BreakerClosed)
+			}
+		case outcomeIgnored:
+			// the probe slot is released for another call
+			b.probes--
+		}
+
+	case BreakerClosed:
+		if o == outcomeIgnored {
+			return
+		}
+
+		b.push(o == outcomeFailure)
+
+		rate := b.config.GetBreakerFailureRate()
+		if rate > 0 && b.calls >= b.config.GetBreakerMinRequests() && float64(b.failures)/float64(b.calls) >= rate {
+			b.open()
+		}
+	}
+}
+
+// push puts the call result to the ring window, forgetting the oldest one.
+func (b *BreakerClient) push(failed bool) {
+	if b.calls == len(b.window) {
+		if b.window[b.next] {
+			b.failures--
+		}
+	} else {
+		b.calls++
+	}
+
+	b.window[b.next] = failed
+	if failed {
+		b.failures++
+	}
+
+	b.next = (b.next + 1) % len(b.window)
+}
+
+func (b *BreakerClient) halfOpenRequests() int {
+	if n := b.config.GetBreakerHalfOpenRequests(); n > 0 {
+		return n
+	}
+
+	return 1
+}
+
+func (b *BreakerClient) open() {
+	b.openedAt = time.Now()
+	b.transit(BreakerOpen)
+}
+
+func (b *BreakerClient) transit(state string) {
+	b.state = state
+	b.generation++
+	b.next = 0
+	b.calls = 0
+	b.failures = 0
+	b.probes = 0
+	b.successes = 0
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	awsClient "github.com/spendmail/face_comparison/internal/aws"
+	"github.com/spendmail/face_comparison/internal/face"
+	"github.com/stretchr/testify/require"
+)
+
+type breakerConfig struct{}
+
+func (breakerConfig) GetBreakerFailureRate() float64       { return 0.5 }
+func (breakerConfig) GetBreakerWindow() int                { return 4 }
+func (breakerConfig) GetBreakerMinRequests() int           { return 4 }
+func (breakerConfig) GetBreakerOpenTimeout() time.Duration { return 50 * time.Millisecond }
+func (breakerConfig) GetBreakerHalfOpenRequests() int      { return 1 }
+
+// switchableRecognitionClient fails while it's broken.
+type switchableRecognitionClient struct {
+	mu     sync.Mutex
+	broken bool
+	calls  int
+	// err is returned while broken, a plain error by default
+	err error
+}
+
+func (c *switchableRecognitionClient) set(broken bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broken = broken
+}
+
+func (c *switchableRecognitionClient) CompareFaces(ctx context.Context, source, target []byte) (face.Comparison, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls++
+	if c.broken {
+		if c.err != nil {
+			return face.Comparison{}, c.err
+		}
+		return face.Comparison{}, errors.New("InternalServerError")
+	}
+
+	return face.Comparison{}, nil
+}
+
+func (c *switchableRecognitionClient) PredictGender(ctx context.Context, source []byte) (string, error) {
+	_, err := c.CompareFaces(ctx, source, source)
+	return "male", err
+}
+
+func (c *switchableRecognitionClient) AnalyzeFaces(ctx context.Context, source []byte) ([]face.Details, error) {
+	_, err := c.CompareFaces(ctx, source, source)
+	return nil, err
+}
+
+func TestBreakerClient(t *testing.T) {
+	client := &switchableRecognitionClient{}
+	breaker := NewBreakerClient(breakerConfig{}, client)
+	ctx := context.Background()
+
+	// one failure of four calls doesn't trip the breaker
+	for i := 0; i < 3; i++ {
+		_, err := breaker.CompareFaces(ctx, nil, nil)
+		require.NoError(t, err)
+	}
+	client.set(true)
+	_, err := breaker.CompareFaces(ctx, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, BreakerClosed, breaker.State())
+
+	// the second failure makes a half of the window
+	_, err = breaker.CompareFaces(ctx, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, BreakerOpen, breaker.State())
+
+	// the backend isn't called while the breaker is open
+	calls := client.calls
+	_, err = breaker.PredictGender(ctx, nil)
+	require.ErrorIs(t, err, ErrBreakerOpen)
+	require.ErrorIs(t, err, awsClient.ErrBackendUnavailable)
+	require.Equal(t, CodeBreakerOpen, ErrorCode(err))
+	require.Equal(t, calls, client.calls)
+
+	// a failed probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, BreakerHalfOpen, breaker.State())
+	_, err = breaker.CompareFaces(ctx, nil, nil)
+	require.NotErrorIs(t, err, ErrBreakerOpen)
+	require.Equal(t, BreakerOpen, breaker.State())
+
+	// a successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	client.set(false)
+	_, err = breaker.CompareFaces(ctx, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, BreakerClosed, breaker.State())
+
+	// canceled calls say nothing about the backend
+	client.set(true)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 10; i++ {
+		_, err = breaker.CompareFaces(canceled, nil, nil)
+		require.Error(t, err)
+	}
+	require.Equal(t, BreakerClosed, breaker.State())
+}
+
+func TestBreakerClientErrors(t *testing.T) {
+	invalidImage := &awsClient.Error{
+		Op:   "compare faces",
+		Kind: awsClient.ErrInvalidImageFormat,
+		Err:  awserr.New(rekognition.ErrCodeInvalidImageFormatException, "bad image", nil),
+	}
+	client := &switchableRecognitionClient{broken: true, err: invalidImage}
+	breaker := NewBreakerClient(breakerConfig{}, client)
+
+	// bad images say nothing about the backend health
+	for i := 0; i < 10; i++ {
+		_, err := breaker.CompareFaces(context.Background(), nil, nil)
+		require.ErrorIs(t, err, awsClient.ErrInvalidImageFormat)
+		require.Equal(t, CodeInvalidImage, ErrorCode(err))
+		require.Equal(t, StatusUnsupportedType, backendStatus(err))
+	}
+	require.Equal(t, BreakerClosed, breaker.State())
+}
@@ -0,0 +1,332 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/face"
+	"github.com/spendmail/face_comparison/internal/review"
+	"github.com/stretchr/testify/require"
+)
+
+// pngHeader is enough for http.DetectContentType to recognize an image.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(args ...interface{}) {}
+func (nopLogger) Info(args ...interface{})  {}
+func (nopLogger) Warn(args ...interface{})  {}
+func (nopLogger) Error(args ...interface{}) {}
+
+type fakeConfig struct{}
+
+func (fakeConfig) GetSimilarityThreshold() float64          { return 90 }
+func (fakeConfig) GetBorderlineThreshold() float64          { return 70 }
+func (fakeConfig) GetReviewFile() string                    { return "" }
+func (fakeConfig) GetReviewRetention() time.Duration        { return 0 }
+func (fakeConfig) GetDownloadWorkers() int                  { return 4 }
+func (fakeConfig) GetDownloadRequestWorkers() int           { return 2 }
+func (fakeConfig) GetCompareWorkers() int                   { return 4 }
+func (fakeConfig) GetCompareRequestWorkers() int            { return 2 }
+func (fakeConfig) GetDownloadConnectTimeout() time.Duration { return time.Second }
+func (fakeConfig) GetDownloadReadTimeout() time.Duration    { return time.Second }
+func (fakeConfig) GetDownloadMaxSize() int64                { return 1024 }
+func (fakeConfig) GetDownloadMaxRedirects() int             { return 2 }
+func (fakeConfig) GetDownloadAllowedNetworks() []string     { return []string{"127.0.0.1"} }
+func (fakeConfig) GetDownloadAllowedDomains() []string      { return []string{} }
+func (fakeConfig) GetDownloadDeniedDomains() []string       { return []string{} }
+
+// fakeRecognitionClient treats the image body after the png header as comma separated face names.
+// Like the real backend asked for raw similarities, it reports every face as a match.
+type fakeRecognitionClient struct{}
+
+func (fakeRecognitionClient) CompareFaces(ctx context.Context, source, target []byte) (face.Comparison, error) {
+	sourceFace := string(bytes.TrimPrefix(source, pngHeader))
+	targetFace := string(bytes.TrimPrefix(target, pngHeader))
+
+	comparison := face.Comparison{
+		SourceFace:     face.Face{BoundingBox: face.BoundingBox{Left: 0.1, Top: 0.2, Width: 0.3, Height: 0.4}, Confidence: 99.9},
+		Matches:        make([]face.Match, 0),
+		UnmatchedFaces: make([]face.Match, 0),
+	}
+
+	if targetFace == "error" {
+		return comparison, errors.New("backend is unavailable")
+	}
+
+	for _, name := range strings.Split(targetFace, ",") {
+		switch {
+		case name == "":
+		case name == sourceFace:
+			comparison.Matches = append(comparison.Matches, face.Match{Similarity: 99.5})
+		case strings.HasPrefix(name, "almost"):
+			comparison.Matches = append(comparison.Matches, face.Match{Similarity: 80})
+		default:
+			comparison.Matches = append(comparison.Matches, face.Match{Similarity: 10})
+		}
+	}
+
+	return comparison, nil
+}
+
+func (fakeRecognitionClient) PredictGender(ctx context.Context, source []byte) (string, error) {
+	return "male", nil
+}
+
+// AnalyzeFaces finds a face per name of the image, every one of them is smiling.
+func (fakeRecognitionClient) AnalyzeFaces(ctx context.Context, source []byte) ([]face.Details, error) {
+	names := string(bytes.TrimPrefix(source, pngHeader))
+	if names == "error" {
+		return nil, errors.New("backend is unavailable")
+	}
+
+	faces := make([]face.Details, 0)
+	for _, name := range strings.Split(names, ",") {
+		if name != "" {
+			faces = append(faces, face.Details{Smile: face.Attribute{Value: true, Confidence: 99}})
+		}
+	}
+
+	return faces, nil
+}
+
+// newImageServer serves /<delay ms>/<face> as a png image and /text as a plain text.
+func newImageServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if parts[0] == "text" {
+			_, _ = w.Write([]byte("plain text"))
+			return
+		}
+
+		delay, _ := strconv.Atoi(parts[0])
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+
+		_, _ = w.Write(append(append([]byte{}, pngHeader...), parts[1]...))
+	}))
+}
+
+func TestCompareImagesOrder(t *testing.T) {
+	server := newImageServer()
+	defer server.Close()
+
+	reviewStore, err := review.New(fakeConfig{})
+	require.NoError(t, err)
+
+	app, err := New(nopLogger{}, fakeConfig{}, fakeRecognitionClient{}, reviewStore)
+	require.NoError(t, err)
+
+	t.Run("slow reference", func(t *testing.T) {
+		reference := server.URL + "/100/alice"
+		targets := []string{
+			server.URL + "/60/bob",
+			server.URL + "/0/alice",
+			server.URL + "/text",
+			server.URL + "/30/",
+			server.URL + "/10/bob,carol",
+			server.URL + "/0/error",
+			server.URL + "/0/almost_alice",
+		}
+
+		result := app.CompareImages(context.Background(), reference, targets, Options{})
+		require.Equal(t, reference, result.Reference.URL)
+		require.Equal(t, StatusReference, result.Reference.Status)
+		require.Equal(t, "male", result.Gender)
+		require.Len(t, result.Targets, len(targets))
+		for i, target := range result.Targets {
+			require.Equal(t, targets[i], target.URL)
+		}
+
+		require.Equal(t, []string{targets[0]}, result.Unmatched())
+		require.Equal(t, []string{targets[4]}, result.MultipleFaces())
+		require.Equal(t, []string{targets[3]}, result.FacesNotFound())
+		require.ErrorIs(t, result.Targets[2].Err, ErrFileNotSupported)
+		require.Len(t, result.Errors, 2)
+
+		require.Equal(t, []string{targets[6]}, result.Borderline())
+
+		statuses := []Status{StatusUnmatched, StatusMatched, StatusUnsupportedType, StatusNoFace, StatusMultipleFaces, StatusBackendError, StatusBorderline}
+		codes := []string{"", "", CodeUnsupportedType, "", "", CodeBackendError, ""}
+		for i, target := range result.Targets {
+			require.Equal(t, statuses[i], target.Status, target.URL)
+			require.Equal(t, codes[i], target.Code, target.URL)
+		}
+		require.Equal(t, 99.5, result.Targets[1].Similarity)
+		require.Equal(t, 99.9, result.Targets[1].Comparison.SourceFace.Confidence)
+		require.Len(t, result.Targets[4].Comparison.UnmatchedFaces, 2)
+		require.Empty(t, result.Targets[4].Comparison.Matches)
+		require.Equal(t, 80.0, result.Targets[6].Similarity)
+
+		pending := reviewStore.Pending()
+		require.Len(t, pending, 1)
+		require.Equal(t, reference, pending[0].Reference)
+		require.Equal(t, targets[6], pending[0].Target)
+		require.Equal(t, 80.0, pending[0].Similarity)
+		require.Nil(t, result.Targets[2].Comparison)
+	})
+
+	t.Run("no targets", func(t *testing.T) {
+		result := app.CompareImages(context.Background(), server.URL+"/0/alice", []string{}, Options{})
+		require.Len(t, result.Errors, 1)
+		require.ErrorIs(t, result.Errors[0], ErrNotEnoughImage)
+	})
+
+	t.Run("gender is skipped", func(t *testing.T) {
+		result := app.CompareImages(context.Background(), server.URL+"/0/alice", []string{server.URL + "/0/alice"}, Options{SkipGender: true})
+		require.Empty(t, result.Errors)
+		require.Empty(t, result.Gender)
+		require.Equal(t, StatusMatched, result.Targets[0].Status)
+	})
+
+	t.Run("targets are reported", func(t *testing.T) {
+		reported := make([]int, 0)
+		result := app.CompareImages(context.Background(), server.URL+"/0/alice", []string{server.URL + "/100/alice", server.URL + "/0/bob"}, Options{
+			OnTarget: func(i int, target ImageResult) {
+				reported = append(reported, i)
+				require.NotEqual(t, StatusSkipped, target.Status)
+			},
+		})
+
+		// the slow target comes last
+		require.Equal(t, []int{1, 0}, reported)
+		require.Equal(t, StatusMatched, result.Targets[0].Status)
+		require.Equal(t, StatusUnmatched, result.Targets[1].Status)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		result := app.CompareImages(ctx, server.URL+"/0/alice", []string{server.URL + "/0/alice", server.URL + "/300/alice"}, Options{})
+		require.Equal(t, StatusReference, result.Reference.Status)
+		require.Equal(t, StatusSkipped, result.Targets[1].Status)
+		require.Equal(t, CodeCanceled, result.Targets[1].Code)
+		require.ErrorIs(t, result.Errors[len(result.Errors)-1], ErrCanceled)
+	})
+
+	t.Run("unavailable reference", func(t *testing.T) {
+		result := app.CompareImages(context.Background(), server.URL+"/text", []string{server.URL + "/0/alice"}, Options{})
+		require.Len(t, result.Errors, 2)
+		require.ErrorIs(t, result.Errors[0], ErrFileNotSupported)
+		require.ErrorIs(t, result.Errors[1], ErrNotEnoughImage)
+		require.Empty(t, result.Gender)
+		require.Equal(t, StatusUnsupportedType, result.Reference.Status)
+		require.Equal(t, StatusSkipped, result.Targets[0].Status)
+		require.Equal(t, CodeNotEnoughImages, result.Targets[0].Code)
+	})
+}
+
+// countingRecognitionClient remembers the largest number of simultaneous comparisons.
+type countingRecognitionClient struct {
+	fakeRecognitionClient
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (c *countingRecognitionClient) CompareFaces(ctx context.Context, source, target []byte) (face.Comparison, error) {
+	c.mu.Lock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	c.mu.Lock()
+	c.current--
+	c.mu.Unlock()
+
+	return c.fakeRecognitionClient.CompareFaces(ctx, source, target)
+}
+
+func TestCompareImagesLimits(t *testing.T) {
+	server := newImageServer()
+	defer server.Close()
+
+	t.Run("comparisons per request", func(t *testing.T) {
+		client := &countingRecognitionClient{}
+		app, err := New(nopLogger{}, fakeConfig{}, client, nil)
+		require.NoError(t, err)
+
+		targets := make([]string, 10)
+		for i := range targets {
+			targets[i] = server.URL + "/0/alice"
+		}
+
+		result := app.CompareImages(context.Background(), server.URL+"/0/alice", targets, Options{})
+		require.Empty(t, result.Errors)
+		require.Equal(t, len(targets), len(result.Targets))
+		require.Equal(t, fakeConfig{}.GetCompareRequestWorkers(), client.max)
+	})
+
+	t.Run("comparisons per process", func(t *testing.T) {
+		client := &countingRecognitionClient{}
+		app, err := New(nopLogger{}, fakeConfig{}, client, nil)
+		require.NoError(t, err)
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				app.CompareImages(context.Background(), server.URL+"/0/alice", []string{server.URL + "/0/alice", server.URL + "/0/alice", server.URL + "/0/bob"}, Options{})
+			}()
+		}
+		wg.Wait()
+
+		require.LessOrEqual(t, client.max, fakeConfig{}.GetCompareWorkers())
+	})
+}
+
+// timingRecognitionClient remembers when every call was made.
+type timingRecognitionClient struct {
+	fakeRecognitionClient
+	mu    sync.Mutex
+	calls map[string]time.Time
+}
+
+func (c *timingRecognitionClient) remember(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[name] = time.Now()
+}
+
+func (c *timingRecognitionClient) CompareFaces(ctx context.Context, source, target []byte) (face.Comparison, error) {
+	c.remember(string(bytes.TrimPrefix(target, pngHeader)))
+	return c.fakeRecognitionClient.CompareFaces(ctx, source, target)
+}
+
+func (c *timingRecognitionClient) PredictGender(ctx context.Context, source []byte) (string, error) {
+	c.remember("gender")
+	return c.fakeRecognitionClient.PredictGender(ctx, source)
+}
+
+func TestCompareImagesPipeline(t *testing.T) {
+	server := newImageServer()
+	defer server.Close()
+
+	client := &timingRecognitionClient{calls: make(map[string]time.Time)}
+	app, err := New(nopLogger{}, fakeConfig{}, client, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	result := app.CompareImages(context.Background(), server.URL+"/0/alice", []string{server.URL + "/300/bob", server.URL + "/0/alice"}, Options{})
+	require.Empty(t, result.Errors)
+	require.Equal(t, "male", result.Gender)
+
+	// neither the fast target nor the gender wait for the slow target download
+	require.Less(t, client.calls["alice"].Sub(start), 200*time.Millisecond)
+	require.Less(t, client.calls["gender"].Sub(start), 200*time.Millisecond)
+	require.GreaterOrEqual(t, client.calls["bob"].Sub(start), 300*time.Millisecond)
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+type DownloaderConfig interface {
+	GuardConfig
+	GetDownloadConnectTimeout() time.Duration
+	GetDownloadReadTimeout() time.Duration
+	GetDownloadMaxSize() int64
+	GetDownloadMaxRedirects() int
+}
+
+// Downloader fetches images by urls.
+// Connect timeout limits dialing and tls handshake, read timeout limits waiting for the response
+// and reading its body, so the whole download never takes longer than both of them together.
+// Every url and every address connected to is checked by the guard.
+type Downloader struct {
+	client  *http.Client
+	guard   *Guard
+	maxSize int64
+}
+
+func NewDownloader(config DownloaderConfig) (*Downloader, error) {
+	connectTimeout := config.GetDownloadConnectTimeout()
+	maxRedirects := config.GetDownloadMaxRedirects()
+
+	guard, err := NewGuard(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: NewTransport(guard, connectTimeout, config.GetDownloadReadTimeout()),
+		Timeout:   connectTimeout + config.GetDownloadReadTimeout(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("%w: stopped after %d redirects", ErrTooManyRedirects, maxRedirects)
+			}
+			return guard.CheckURL(req.URL)
+		},
+	}
+
+	return &Downloader{
+		client:  client,
+		guard:   guard,
+		maxSize: config.GetDownloadMaxSize(),
+	}, nil
+}
+
+// Download returns the response body of a successful GET request to url.
+func (d *Downloader) Download(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return []byte{}, wrap.New(ErrRequest, err)
+	}
+
+	if err := d.guard.CheckURL(request.URL); err != nil {
+		return []byte{}, err
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return []byte{}, d.requestError(ctx, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return []byte{}, fmt.Errorf("%w: %s responded with %s", ErrHTTPStatus, url, response.Status)
+	}
+
+	if d.maxSize > 0 && response.ContentLength > d.maxSize {
+		return []byte{}, fmt.Errorf("%w: %s is %d bytes, %d at most", ErrTooLarge, url, response.ContentLength, d.maxSize)
+	}
+
+	body := io.Reader(response.Body)
+	if d.maxSize > 0 {
+		// reading one byte over the limit is enough to know the body is too large
+		body = io.LimitReader(response.Body, d.maxSize+1)
+	}
+
+	responseBytes, err := io.ReadAll(body)
+	if err != nil {
+		return []byte{}, d.readError(ctx, err)
+	}
+
+	if d.maxSize > 0 && int64(len(responseBytes)) > d.maxSize {
+		return []byte{}, fmt.Errorf("%w: %s is more than %d bytes", ErrTooLarge, url, d.maxSize)
+	}
+
+	return responseBytes, nil
+}
+
+func (d *Downloader) requestError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return wrap.New(ErrCanceled, ctx.Err())
+	}
+
+	if errors.Is(err, ErrTooManyRedirects) || errors.Is(err, ErrBlocked) {
+		return err
+	}
+
+	// Identifying wrong domain name errors.
+	var DNSError *net.DNSError
+	if errors.As(err, &DNSError) {
+		return wrap.New(ErrServerNotExists, err)
+	}
+
+	if isTimeout(err) {
+		return wrap.New(ErrTimeout, err)
+	}
+
+	return wrap.New(ErrDownload, err)
+}
+
+func (d *Downloader) readError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return wrap.New(ErrCanceled, ctx.Err())
+	}
+
+	if isTimeout(err) {
+		return wrap.New(ErrTimeout, err)
+	}
+
+	return wrap.New(ErrFileRead, err)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
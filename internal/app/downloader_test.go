@@ -0,0 +1,179 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type downloaderConfig struct {
+	readTimeout     time.Duration
+	allowedNetworks []string
+	allowedDomains  []string
+	deniedDomains   []string
+}
+
+func (c downloaderConfig) GetDownloadConnectTimeout() time.Duration { return time.Second }
+func (c downloaderConfig) GetDownloadReadTimeout() time.Duration    { return c.readTimeout }
+func (c downloaderConfig) GetDownloadMaxSize() int64                { return 16 }
+func (c downloaderConfig) GetDownloadMaxRedirects() int             { return 2 }
+func (c downloaderConfig) GetDownloadAllowedNetworks() []string     { return c.allowedNetworks }
+func (c downloaderConfig) GetDownloadAllowedDomains() []string      { return c.allowedDomains }
+func (c downloaderConfig) GetDownloadDeniedDomains() []string       { return c.deniedDomains }
+
+func TestDownloader(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(pngHeader)
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>not found</html>", http.StatusNotFound)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte{0}, 17))
+	})
+	mux.HandleFunc("/large/chunked", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 17; i++ {
+			_, _ = w.Write([]byte{0})
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write(pngHeader)
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Path[len("/redirect/"):])
+		if n == 0 {
+			_, _ = w.Write(pngHeader)
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(n-1), http.StatusFound)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	downloader, err := NewDownloader(downloaderConfig{readTimeout: 100 * time.Millisecond, allowedNetworks: []string{"127.0.0.0/8"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		path string
+		err  error
+		code string
+	}{
+		{name: "ok", path: "/ok"},
+		{name: "http status", path: "/missing", err: ErrHTTPStatus, code: CodeHTTPStatus},
+		{name: "too large", path: "/large", err: ErrTooLarge, code: CodeTooLarge},
+		{name: "too large without content length", path: "/large/chunked", err: ErrTooLarge, code: CodeTooLarge},
+		{name: "timeout", path: "/slow", err: ErrTimeout, code: CodeTimeout},
+		{name: "redirects", path: "/redirect/2"},
+		{name: "too many redirects", path: "/redirect/3", err: ErrTooManyRedirects, code: CodeTooManyRedirects},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			content, err := downloader.Download(context.Background(), server.URL+tc.path)
+			if tc.err == nil {
+				require.NoError(t, err)
+				require.Equal(t, pngHeader, content)
+				return
+			}
+
+			require.ErrorIs(t, err, tc.err)
+			require.Equal(t, tc.code, ErrorCode(err))
+		})
+	}
+
+	t.Run("cause is kept", func(t *testing.T) {
+		_, err := downloader.Download(context.Background(), server.URL+"/slow")
+
+		var netErr net.Error
+		require.True(t, errors.As(err, &netErr))
+		require.True(t, netErr.Timeout())
+	})
+}
+
+func TestDownloaderGuard(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		_, _ = w.Write(pngHeader)
+	}))
+	defer server.Close()
+
+	t.Run("loopback is blocked by default", func(t *testing.T) {
+		downloader, err := NewDownloader(downloaderConfig{readTimeout: time.Second})
+		require.NoError(t, err)
+
+		_, err = downloader.Download(context.Background(), server.URL+"/ok")
+		require.ErrorIs(t, err, ErrBlocked)
+		require.Equal(t, CodeBlocked, ErrorCode(err))
+
+		// the host name is resolved to the loopback address too
+		_, err = downloader.Download(context.Background(), strings.Replace(server.URL, "127.0.0.1", "localhost", 1)+"/ok")
+		require.ErrorIs(t, err, ErrBlocked)
+	})
+
+	t.Run("redirect to metadata", func(t *testing.T) {
+		downloader, err := NewDownloader(downloaderConfig{readTimeout: time.Second, allowedNetworks: []string{"127.0.0.1"}})
+		require.NoError(t, err)
+
+		_, err = downloader.Download(context.Background(), server.URL+"/ok")
+		require.NoError(t, err)
+
+		_, err = downloader.Download(context.Background(), server.URL+"/redirect")
+		require.ErrorIs(t, err, ErrBlocked)
+	})
+
+	t.Run("domains", func(t *testing.T) {
+		downloader, err := NewDownloader(downloaderConfig{
+			readTimeout:    time.Second,
+			allowedDomains: []string{"example.com"},
+			deniedDomains:  []string{"private.example.com"},
+		})
+		require.NoError(t, err)
+
+		_, err = downloader.Download(context.Background(), "http://img.private.example.com/1.jpg")
+		require.ErrorIs(t, err, ErrBlocked)
+
+		_, err = downloader.Download(context.Background(), "http://example.org/1.jpg")
+		require.ErrorIs(t, err, ErrBlocked)
+
+		_, err = downloader.Download(context.Background(), "file:///etc/passwd")
+		require.ErrorIs(t, err, ErrBlocked)
+	})
+
+	t.Run("wrong network", func(t *testing.T) {
+		_, err := NewDownloader(downloaderConfig{allowedNetworks: []string{"10.0.0.0/33"}})
+		require.ErrorIs(t, err, ErrWrongNetwork)
+	})
+}
+
+func TestGuardCheckIP(t *testing.T) {
+	guard, err := NewGuard(downloaderConfig{allowedNetworks: []string{"10.1.0.0/16"}})
+	require.NoError(t, err)
+
+	blocked := []string{"127.0.0.1", "::1", "169.254.169.254", "fd00:ec2::254", "10.0.0.1", "172.16.0.1", "192.168.1.1", "0.0.0.0", "100.64.0.1", "::ffff:127.0.0.1"}
+	for _, ip := range blocked {
+		require.ErrorIs(t, guard.CheckIP(net.ParseIP(ip)), ErrBlocked, ip)
+	}
+
+	allowed := []string{"8.8.8.8", "2001:4860:4860::8888", "10.1.2.3"}
+	for _, ip := range allowed {
+		require.NoError(t, guard.CheckIP(net.ParseIP(ip)), ip)
+	}
+}
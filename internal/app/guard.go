@@ -0,0 +1,207 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+type GuardConfig interface {
+	GetDownloadAllowedNetworks() []string
+	GetDownloadAllowedDomains() []string
+	GetDownloadDeniedDomains() []string
+}
+
+// Guard keeps the downloader away from internal addresses.
+// Loopback, link-local (cloud metadata included), private and other non-public addresses are blocked
+// unless they belong to an allowed network. Domains are checked against the deny list first,
+// then, if the allow list isn't empty, a domain has to be on it.
+type Guard struct {
+	allowedNetworks []*net.IPNet
+	allowedDomains  []string
+	deniedDomains   []string
+}
+
+// blockedNetworks are the non-public ranges not covered by the net.IP classification methods.
+var blockedNetworks = mustParseNetworks(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade nat
+	"192.0.0.0/24",  // ietf protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+)
+
+func NewGuard(config GuardConfig) (*Guard, error) {
+	return NewGuardFromLists(config.GetDownloadAllowedNetworks(), config.GetDownloadAllowedDomains(), config.GetDownloadDeniedDomains())
+}
+
+// NewGuardFromLists makes a guard of its own lists, for the urls other than the downloaded ones.
+func NewGuardFromLists(allowedNetworks, allowedDomains, deniedDomains []string) (*Guard, error) {
+	networks, err := parseNetworks(allowedNetworks...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Guard{
+		allowedNetworks: networks,
+		allowedDomains:  normalizeDomains(allowedDomains),
+		deniedDomains:   normalizeDomains(deniedDomains),
+	}, nil
+}
+
+// NewTransport returns a transport which connects only to the addresses the guard lets through.
+// No proxy is used on purpose, the guard has to see the addresses of the remote servers.
+func NewTransport(guard *Guard, connectTimeout, responseTimeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: connectTimeout,
+		Control: guard.Control,
+	}
+
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: responseTimeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// CheckURL validates the url scheme and host name, it's called for every redirect as well.
+func (g *Guard) CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrBlocked, u.Scheme)
+	}
+
+	host := normalizeDomain(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: host is empty", ErrBlocked)
+	}
+
+	if matchDomain(host, g.deniedDomains) {
+		return fmt.Errorf("%w: domain %s is denied", ErrBlocked, host)
+	}
+
+	if len(g.allowedDomains) > 0 && !matchDomain(host, g.allowedDomains) {
+		return fmt.Errorf("%w: domain %s is not allowed", ErrBlocked, host)
+	}
+
+	return nil
+}
+
+// CheckIP blocks non-public addresses unless they are allowed explicitly.
+func (g *Guard) CheckIP(ip net.IP) error {
+	for _, network := range g.allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+
+	if !isPublic(ip) {
+		return fmt.Errorf("%w: address %s is not public", ErrBlocked, ip)
+	}
+
+	return nil
+}
+
+// Control is called by the dialer with an already resolved address right before connecting,
+// so a host name can't be resolved to a different address after it's checked.
+func (g *Guard) Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return wrap.New(ErrBlocked, err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: address %s is not an ip", ErrBlocked, host)
+	}
+
+	return g.CheckIP(ip)
+}
+
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchDomain reports whether the host is one of the domains or their subdomain.
+func matchDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if domain = normalizeDomain(domain); domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+
+	return normalized
+}
+
+// parseNetworks accepts both networks in cidr notation and single addresses.
+func parseNetworks(networks ...string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %q", ErrWrongNetwork, network)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, wrap.New(ErrWrongNetwork, err)
+		}
+
+		parsed = append(parsed, ipNet)
+	}
+
+	return parsed, nil
+}
+
+func mustParseNetworks(networks ...string) []*net.IPNet {
+	parsed, err := parseNetworks(networks...)
+	if err != nil {
+		panic(err)
+	}
+
+	return parsed
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	awsClient "github.com/spendmail/face_comparison/internal/aws"
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+type RateLimitConfig interface {
+	GetCompareFacesRate() float64
+	GetCompareFacesBurst() int
+	GetDetectFacesRate() float64
+	GetDetectFacesBurst() int
+	GetRateLimitWait() time.Duration
+}
+
+// RateLimiter keeps the backend calls of the whole process within the account quota.
+// The recognition client waits on it before every attempt, so the retries take their tokens as well.
+// Every operation has its own token bucket, a call waits for a token until ctx is done
+// or the configured wait runs out, whichever comes first.
+type RateLimiter struct {
+	compareFaces *tokenBucket
+	detectFaces  *tokenBucket
+	wait         time.Duration
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		compareFaces: newTokenBucket(config.GetCompareFacesRate(), config.GetCompareFacesBurst()),
+		detectFaces:  newTokenBucket(config.GetDetectFacesRate(), config.GetDetectFacesBurst()),
+		wait:         config.GetRateLimitWait(),
+	}
+}
+
+// Wait takes a token of the operation, the unknown operations aren't limited.
+func (l *RateLimiter) Wait(ctx context.Context, op string) error {
+	var bucket *tokenBucket
+	switch op {
+	case awsClient.OpCompareFaces:
+		bucket = l.compareFaces
+	case awsClient.OpDetectFaces:
+		bucket = l.detectFaces
+	}
+
+	if l.wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.wait)
+		defer cancel()
+	}
+
+	return bucket.take(ctx)
+}
+
+// tokenBucket allows rate calls per second on average and up to burst calls at once.
+// A nil bucket doesn't limit anything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take reserves a token and waits until it's available.
+// If the token can't be available before ctx is done, it fails right away without waiting.
+func (b *tokenBucket) take(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	delay := time.Duration(0)
+	if b.tokens < 1 {
+		delay = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		b.mu.Unlock()
+		return fmt.Errorf("%w: no capacity left within %s", ErrRateLimited, delay)
+	}
+
+	b.tokens--
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// the reserved token isn't going to be used
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+
+		return wrap.New(ErrRateLimited, ctx.Err())
+	}
+}
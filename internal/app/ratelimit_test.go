@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	awsClient "github.com/spendmail/face_comparison/internal/aws"
+	"github.com/stretchr/testify/require"
+)
+
+type rateLimitConfig struct {
+	wait time.Duration
+}
+
+func (c rateLimitConfig) GetCompareFacesRate() float64    { return 10 }
+func (c rateLimitConfig) GetCompareFacesBurst() int       { return 2 }
+func (c rateLimitConfig) GetDetectFacesRate() float64     { return 0 }
+func (c rateLimitConfig) GetDetectFacesBurst() int        { return 0 }
+func (c rateLimitConfig) GetRateLimitWait() time.Duration { return c.wait }
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("waits for a token", func(t *testing.T) {
+		limiter := NewRateLimiter(rateLimitConfig{wait: time.Second})
+
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			err := limiter.Wait(context.Background(), awsClient.OpCompareFaces)
+			require.NoError(t, err)
+		}
+
+		// two calls fit into the burst, the next two wait for 100ms each
+		require.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+	})
+
+	t.Run("fails when the wait is over", func(t *testing.T) {
+		limiter := NewRateLimiter(rateLimitConfig{wait: 50 * time.Millisecond})
+
+		for i := 0; i < 2; i++ {
+			err := limiter.Wait(context.Background(), awsClient.OpCompareFaces)
+			require.NoError(t, err)
+		}
+
+		err := limiter.Wait(context.Background(), awsClient.OpCompareFaces)
+		require.ErrorIs(t, err, ErrRateLimited)
+		require.Equal(t, CodeRateLimited, ErrorCode(err))
+	})
+
+	t.Run("fails when the context deadline is too close", func(t *testing.T) {
+		limiter := NewRateLimiter(rateLimitConfig{})
+
+		for i := 0; i < 2; i++ {
+			err := limiter.Wait(context.Background(), awsClient.OpCompareFaces)
+			require.NoError(t, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := limiter.Wait(ctx, awsClient.OpCompareFaces)
+		require.ErrorIs(t, err, ErrRateLimited)
+		require.Less(t, time.Since(start), 20*time.Millisecond)
+	})
+
+	t.Run("unlimited operation", func(t *testing.T) {
+		limiter := NewRateLimiter(rateLimitConfig{})
+
+		for i := 0; i < 100; i++ {
+			err := limiter.Wait(context.Background(), awsClient.OpDetectFaces)
+			require.NoError(t, err)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+// semaphore limits the number of goroutines doing the same kind of work at once.
+// A nil semaphore doesn't limit anything.
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size <= 0 {
+		return nil
+	}
+
+	return make(semaphore, size)
+}
+
+// acquire blocks until there is a free slot or ctx is done.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return wrap.New(ErrCanceled, ctx.Err())
+	}
+}
+
+func (s semaphore) release() {
+	if s == nil {
+		return
+	}
+
+	<-s
+}
+
+// limiter combines the per-request limit with the process-wide one.
+// The request slot is taken first, so waiting requests don't hold global slots.
+type limiter struct {
+	request semaphore
+	global  semaphore
+}
+
+func (l limiter) acquire(ctx context.Context) error {
+	if err := l.request.acquire(ctx); err != nil {
+		return err
+	}
+
+	if err := l.global.acquire(ctx); err != nil {
+		l.request.release()
+		return err
+	}
+
+	return nil
+}
+
+func (l limiter) release() {
+	l.global.release()
+	l.request.release()
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"errors"
+
+	awsClient "github.com/spendmail/face_comparison/internal/aws"
+	"github.com/spendmail/face_comparison/internal/face"
+)
+
+// Status describes what happened to a single image of the comparison.
+type Status string
+
+const (
+	StatusReference       Status = "reference"
+	StatusMatched         Status = "matched"
+	StatusUnmatched       Status = "unmatched"
+	StatusBorderline      Status = "borderline"
+	StatusMultipleFaces   Status = "multiple_faces"
+	StatusNoFace          Status = "no_face"
+	StatusDownloadFailed  Status = "download_failed"
+	StatusUnsupportedType Status = "unsupported_type"
+	StatusBackendError    Status = "backend_error"
+	StatusSkipped         Status = "skipped"
+)
+
+// Machine-readable error codes, clients are supposed to rely on them instead of error messages.
+const (
+	CodeInvalidURL       = "invalid_url"
+	CodeHostNotFound     = "host_not_found"
+	CodeDownloadFailed   = "download_failed"
+	CodeReadFailed       = "read_failed"
+	CodeUnsupportedType  = "unsupported_type"
+	CodeNotEnoughImages  = "not_enough_images"
+	CodeBackendError     = "backend_error"
+	CodeCanceled         = "canceled"
+	CodeHTTPStatus       = "http_status"
+	CodeTooLarge         = "too_large"
+	CodeTimeout          = "timeout"
+	CodeTooManyRedirects = "too_many_redirects"
+	CodeBlocked          = "blocked_url"
+	CodeRateLimited      = "rate_limited"
+	CodeBreakerOpen      = "backend_unavailable"
+	CodeAccessDenied     = "access_denied"
+	CodeImageTooLarge    = "image_too_large"
+	CodeInvalidImage     = "invalid_image_format"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeNoFace           = "no_face"
+	CodeInternalError    = "internal_error"
+)
+
+// ErrorCode maps an application error to its machine-readable code.
+func ErrorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrRequest):
+		return CodeInvalidURL
+	case errors.Is(err, ErrServerNotExists):
+		return CodeHostNotFound
+	case errors.Is(err, ErrDownload):
+		return CodeDownloadFailed
+	case errors.Is(err, ErrFileRead):
+		return CodeReadFailed
+	case errors.Is(err, ErrFileNotSupported):
+		return CodeUnsupportedType
+	case errors.Is(err, ErrNotEnoughImage):
+		return CodeNotEnoughImages
+	case errors.Is(err, ErrCanceled):
+		return CodeCanceled
+	case errors.Is(err, ErrHTTPStatus):
+		return CodeHTTPStatus
+	case errors.Is(err, ErrTooLarge):
+		return CodeTooLarge
+	case errors.Is(err, ErrTimeout):
+		return CodeTimeout
+	case errors.Is(err, ErrTooManyRedirects):
+		return CodeTooManyRedirects
+	case errors.Is(err, ErrBlocked):
+		return CodeBlocked
+	case errors.Is(err, ErrRateLimited):
+		return CodeRateLimited
+	case errors.Is(err, ErrBreakerOpen):
+		return CodeBreakerOpen
+	}
+
+	if code := backendCode(err); code != CodeBackendError {
+		return code
+	}
+
+	var awsErr *awsClient.Error
+	if errors.As(err, &awsErr) {
+		return CodeBackendError
+	}
+
+	return CodeInternalError
+}
+
+// backendCode returns a code of the failed recognition call.
+func backendCode(err error) string {
+	switch {
+	case errors.Is(err, ErrRateLimited), errors.Is(err, awsClient.ErrThrottled):
+		return CodeRateLimited
+	case errors.Is(err, ErrBreakerOpen), errors.Is(err, awsClient.ErrBackendUnavailable):
+		return CodeBreakerOpen
+	case errors.Is(err, awsClient.ErrAccessDenied):
+		return CodeAccessDenied
+	case errors.Is(err, awsClient.ErrImageTooLarge):
+		return CodeImageTooLarge
+	case errors.Is(err, awsClient.ErrInvalidImageFormat):
+		return CodeInvalidImage
+	case errors.Is(err, awsClient.ErrInvalidParameter), errors.Is(err, awsClient.ErrInvalidS3Object):
+		return CodeInvalidParameter
+	case errors.Is(err, awsClient.ErrNoFace):
+		return CodeNoFace
+	default:
+		return CodeBackendError
+	}
+}
+
+// backendStatus returns a status of a target which the backend failed to compare.
+func backendStatus(err error) Status {
+	switch {
+	case errors.Is(err, awsClient.ErrInvalidImageFormat):
+		return StatusUnsupportedType
+	case errors.Is(err, awsClient.ErrNoFace):
+		return StatusNoFace
+	default:
+		return StatusBackendError
+	}
+}
+
+// downloadStatus returns a status of an image which wasn't downloaded or validated.
+func downloadStatus(err error) Status {
+	if errors.Is(err, ErrFileNotSupported) {
+		return StatusUnsupportedType
+	}
+
+	if errors.Is(err, ErrCanceled) {
+		return StatusSkipped
+	}
+
+	return StatusDownloadFailed
+}
+
+// comparisonStatus classifies a target by the number of faces found in it.
+// The comparison is expected to be split by the similarity threshold already,
+// a single unmatched face within the gray zone makes the target borderline.
+func comparisonStatus(comparison face.Comparison, borderlineThreshold float64) Status {
+	unmatchedCnt := len(comparison.UnmatchedFaces)
+	matchedCnt := len(comparison.Matches)
+
+	switch {
+	case unmatchedCnt == 1:
+		if borderlineThreshold > 0 && comparison.UnmatchedFaces[0].Similarity >= borderlineThreshold {
+			return StatusBorderline
+		}
+		return StatusUnmatched
+	case unmatchedCnt > 1:
+		return StatusMultipleFaces
+	case matchedCnt == 0:
+		return StatusNoFace
+	default:
+		return StatusMatched
+	}
+}
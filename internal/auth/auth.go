@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Config interface {
+	GetSecret() string
+	GetQuerySecret() bool
+	GetAPIKeys() []string
+	GetAPIKeysFile() string
+	GetSignedRequests() bool
+	GetSignatureMaxAge() time.Duration
+	GetNonceWindow() int
+	GetJWTHMACKeyFile() string
+	GetJWTPublicKeyFiles() []string
+	GetJWTJWKSFile() string
+	GetJWTIssuer() string
+	GetJWTAudience() string
+}
+
+// Methods a client is authenticated with.
+const (
+	MethodAPIKey      = "api_key"
+	MethodQuerySecret = "query_secret"
+	MethodSignature   = "signature"
+	MethodJWT         = "jwt"
+)
+
+// Features a token may be limited to.
+const (
+	FeatureCompare = "compare"
+	FeatureGender  = "gender"
+	FeatureReview  = "review"
+	FeatureAnalyze = "analyze"
+)
+
+// DefaultFeatures are allowed to the clients that aren't granted any features explicitly, review is not among them.
+var DefaultFeatures = []string{FeatureCompare, FeatureGender, FeatureAnalyze}
+
+var (
+	ErrNoCredentials  = errors.New("no credentials")
+	ErrUnknownKey     = errors.New("unknown api key")
+	ErrKeyExpired     = errors.New("api key expired")
+	ErrWrongSecret    = errors.New("wrong secret code")
+	ErrWrongKey       = errors.New("wrong api key")
+	ErrKeysRead       = errors.New("unable to read api keys file")
+	ErrWrongSignature = errors.New("wrong request signature")
+	ErrStaleRequest   = errors.New("request timestamp is out of the allowed window")
+	ErrReplayed       = errors.New("request nonce is already used")
+	ErrTooManyNonces  = errors.New("too many signed requests, try again later")
+	ErrWrongToken     = errors.New("wrong token")
+	ErrTokenExpired   = errors.New("token expired")
+	ErrJWTKeysRead    = errors.New("unable to read jwt keys")
+)
+
+// Client is an authenticated caller.
+// Clients are limited to the features of their key or token, or to the default features if none are granted.
+type Client struct {
+	Name     string
+	Method   string
+	Tenant   string
+	MaxURLs  int
+	Features []string
+}
+
+// Allows reports whether the client may use the feature.
+func (c Client) Allows(feature string) bool {
+	features := c.Features
+	if features == nil {
+		features = DefaultFeatures
+	}
+
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator checks api keys sent in the Authorization or X-API-Key headers.
+// The shared secret is accepted as a key named "default", it's also accepted in the secret query parameter
+// unless the query secret is turned off, which is going to be the only option.
+// If signed requests are on, a request can be signed with a key instead of sending it, see Sign.
+// If jwt keys are configured, a bearer token may be a jwt as well.
+type Authenticator struct {
+	keys        []Key
+	secret      string
+	querySecret bool
+
+	signedRequests bool
+	maxAge         time.Duration
+	nonces         *nonceWindow
+
+	jwt *jwtVerifier
+}
+
+func New(config Config) (*Authenticator, error) {
+	keys, err := ParseKeys(config.GetAPIKeys())
+	if err != nil {
+		return nil, err
+	}
+
+	if file := config.GetAPIKeysFile(); file != "" {
+		fileKeys, err := ReadKeys(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	if secret := config.GetSecret(); secret != "" {
+		keys = append(keys, Key{Name: "default", Key: secret})
+	}
+
+	jwt, err := newJWTVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authenticator{
+		keys:           keys,
+		secret:         config.GetSecret(),
+		querySecret:    config.GetQuerySecret(),
+		signedRequests: config.GetSignedRequests(),
+		maxAge:         config.GetSignatureMaxAge(),
+		nonces:         newNonceWindow(config.GetNonceWindow()),
+		jwt:            jwt,
+	}, nil
+}
+
+func (a *Authenticator) Authenticate(r *http.Request) (Client, error) {
+	if a.signedRequests && signed(r) {
+		return a.checkSignature(r, time.Now())
+	}
+
+	if token, ok := bearerToken(r); ok && a.jwt != nil && looksLikeJWT(token) {
+		return a.checkToken(token, time.Now())
+	}
+
+	if key, ok := apiKey(r); ok {
+		return a.checkKey(key, time.Now())
+	}
+
+	if !a.querySecret {
+		return Client{}, ErrNoCredentials
+	}
+
+	secret := r.URL.Query().Get("secret")
+	if equal(secret, a.secret) {
+		return Client{Name: "default", Method: MethodQuerySecret}, nil
+	}
+
+	if secret == "" {
+		return Client{}, ErrNoCredentials
+	}
+
+	return Client{}, ErrWrongSecret
+}
+
+// checkKey compares the key with all the known ones, so the time taken doesn't tell which of them matched.
+func (a *Authenticator) checkKey(key string, now time.Time) (Client, error) {
+	match := -1
+	for i := range a.keys {
+		if equal(key, a.keys[i].Key) {
+			match = i
+		}
+	}
+
+	if match < 0 {
+		return Client{}, ErrUnknownKey
+	}
+
+	if a.keys[match].Expired(now) {
+		return Client{}, ErrKeyExpired
+	}
+
+	return Client{Name: a.keys[match].Name, Method: MethodAPIKey, Features: a.keys[match].Features}, nil
+}
+
+func (a *Authenticator) checkToken(token string, now time.Time) (Client, error) {
+	claims, err := a.jwt.verify(token, now)
+	if err != nil {
+		return Client{}, err
+	}
+
+	name := claims.Subject
+	if name == "" {
+		name = claims.Tenant
+	}
+
+	return Client{
+		Name:     name,
+		Method:   MethodJWT,
+		Tenant:   claims.Tenant,
+		MaxURLs:  claims.MaxURLs,
+		Features: claims.AllowedFeatures,
+	}, nil
+}
+
+// key looks a key up by its name, the last one wins if the names are repeated.
+func (a *Authenticator) key(name string) (Key, bool) {
+	for i := len(a.keys) - 1; i >= 0; i-- {
+		if a.keys[i].Name == name {
+			return a.keys[i], true
+		}
+	}
+
+	return Key{}, false
+}
+
+// apiKey returns the key sent as "Authorization: ApiKey <key>", "Authorization: Bearer <key>" or "X-API-Key: <key>".
+func apiKey(r *http.Request) (string, bool) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, true
+	}
+
+	if key, ok := authorization(r, "ApiKey"); ok {
+		return key, true
+	}
+
+	return bearerToken(r)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	return authorization(r, "Bearer")
+}
+
+// authorization returns the credentials of the Authorization header with the given scheme.
+func authorization(r *http.Request, scheme string) (string, bool) {
+	s, credentials, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(s, scheme) {
+		return "", false
+	}
+
+	credentials = strings.TrimSpace(credentials)
+
+	return credentials, credentials != ""
+}
+
+// equal compares the digests in constant time, so neither the contents nor the length of a key leak.
+func equal(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
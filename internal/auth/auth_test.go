@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeConfig struct {
+	secret      string
+	querySecret bool
+	keys        []string
+	keysFile    string
+	signed      bool
+	nonceWindow int
+	jwtHMACKey  string
+	jwtPEMFiles []string
+	jwtJWKSFile string
+	jwtAudience string
+}
+
+func (c fakeConfig) GetSecret() string                 { return c.secret }
+func (c fakeConfig) GetQuerySecret() bool              { return c.querySecret }
+func (c fakeConfig) GetAPIKeys() []string              { return c.keys }
+func (c fakeConfig) GetAPIKeysFile() string            { return c.keysFile }
+func (c fakeConfig) GetSignedRequests() bool           { return c.signed }
+func (c fakeConfig) GetSignatureMaxAge() time.Duration { return time.Minute }
+func (c fakeConfig) GetNonceWindow() int               { return c.nonceWindow }
+func (c fakeConfig) GetJWTHMACKeyFile() string         { return c.jwtHMACKey }
+func (c fakeConfig) GetJWTPublicKeyFiles() []string    { return c.jwtPEMFiles }
+func (c fakeConfig) GetJWTJWKSFile() string            { return c.jwtJWKSFile }
+func (c fakeConfig) GetJWTIssuer() string              { return "" }
+func (c fakeConfig) GetJWTAudience() string            { return c.jwtAudience }
+
+func TestAuthenticator(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(file, []byte(`[{"name": "file", "key": "from-file"}]`), 0o600))
+
+	authenticator, err := New(fakeConfig{
+		secret:   "secret",
+		keys:     []string{"partner:key", "expired:old:2020-01-01T00:00:00Z", "future:new:2999-01-01T00:00:00Z"},
+		keysFile: file,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		query  string
+		client string
+		err    error
+	}{
+		{name: "x-api-key", header: http.Header{"X-Api-Key": {"key"}}, client: "partner"},
+		{name: "api key scheme", header: http.Header{"Authorization": {"ApiKey from-file"}}, client: "file"},
+		{name: "bearer scheme", header: http.Header{"Authorization": {"Bearer new"}}, client: "future"},
+		{name: "shared secret", header: http.Header{"X-Api-Key": {"secret"}}, client: "default"},
+		{name: "expired", header: http.Header{"X-Api-Key": {"old"}}, err: ErrKeyExpired},
+		{name: "unknown", header: http.Header{"X-Api-Key": {"unknown"}}, err: ErrUnknownKey},
+		{name: "other scheme", header: http.Header{"Authorization": {"Basic a2V5"}}, err: ErrNoCredentials},
+		{name: "query secret is off", query: "?secret=secret", err: ErrNoCredentials},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/compare/"+tt.query, nil)
+			r.Header = tt.header
+
+			client, err := authenticator.Authenticate(r)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.client, client.Name)
+			require.Equal(t, MethodAPIKey, client.Method)
+		})
+	}
+}
+
+func TestAuthenticatorQuerySecret(t *testing.T) {
+	authenticator, err := New(fakeConfig{secret: "secret", querySecret: true})
+	require.NoError(t, err)
+
+	for query, expected := range map[string]error{"?secret=secret": nil, "?secret=wrong": ErrWrongSecret, "": ErrNoCredentials} {
+		r := httptest.NewRequest(http.MethodPost, "/compare/"+query, nil)
+
+		client, err := authenticator.Authenticate(r)
+		if expected != nil {
+			require.ErrorIs(t, err, expected)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, MethodQuerySecret, client.Method)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys([]string{"partner:key:2030-01-01T00:00:00Z"})
+	require.NoError(t, err)
+	require.Equal(t, "partner", keys[0].Name)
+	require.False(t, keys[0].Expired(time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.True(t, keys[0].Expired(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	for _, wrong := range []string{"key", "partner:", "partner:key:tomorrow"} {
+		_, err := ParseKeys([]string{wrong})
+		require.ErrorIs(t, err, ErrWrongKey, wrong)
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	_, err := ReadKeys(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorIs(t, err, ErrKeysRead)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestKeyFeatures(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(file, []byte(`[{"name": "reviewer", "key": "reviewer", "features": ["compare", "review"]}]`), 0o600))
+
+	authenticator, err := New(fakeConfig{secret: "secret", keys: []string{"partner:key"}, keysFile: file})
+	require.NoError(t, err)
+
+	features := func(key string) []bool {
+		r := httptest.NewRequest(http.MethodPost, "/compare/", nil)
+		r.Header.Set("X-API-Key", key)
+
+		client, err := authenticator.Authenticate(r)
+		require.NoError(t, err)
+
+		return []bool{client.Allows(FeatureCompare), client.Allows(FeatureGender), client.Allows(FeatureReview)}
+	}
+
+	require.Equal(t, []bool{true, true, false}, features("key"))
+	require.Equal(t, []bool{true, true, false}, features("secret"))
+	require.Equal(t, []bool{true, false, true}, features("reviewer"))
+
+	require.NoError(t, os.WriteFile(file, []byte(`[{"name": "reviewer", "key": "reviewer", "features": ["admin"]}]`), 0o600))
+	_, err = ReadKeys(file)
+	require.ErrorIs(t, err, ErrWrongKey)
+}
+
+func TestAuthenticatorSignature(t *testing.T) {
+	authenticator, err := New(fakeConfig{keys: []string{"partner:key", "expired:old:2020-01-01T00:00:00Z"}, signed: true, nonceWindow: 2})
+	require.NoError(t, err)
+
+	body := `{"urls": ["a", "b"]}`
+	request := func(name, key string, signedAt time.Time, nonce, sentBody string) *http.Request {
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+
+		r := httptest.NewRequest(http.MethodPost, "/v2/compare/", strings.NewReader(sentBody))
+		r.Header.Set(HeaderKeyID, name)
+		r.Header.Set(HeaderTimestamp, timestamp)
+		r.Header.Set(HeaderNonce, nonce)
+		r.Header.Set(HeaderSignature, Sign(key, http.MethodPost, "/v2/compare/", timestamp, nonce, []byte(body)))
+
+		return r
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		r := request("partner", "key", time.Now(), "1", body)
+
+		client, err := authenticator.Authenticate(r)
+		require.NoError(t, err)
+		require.Equal(t, Client{Name: "partner", Method: MethodSignature}, client)
+
+		// the handler reads the body as it was sent
+		read, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, body, string(read))
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		_, err := authenticator.Authenticate(request("partner", "key", time.Now(), "2", body))
+		require.NoError(t, err)
+
+		_, err = authenticator.Authenticate(request("partner", "key", time.Now(), "2", body))
+		require.ErrorIs(t, err, ErrReplayed)
+	})
+
+	t.Run("window is full", func(t *testing.T) {
+		_, err := authenticator.Authenticate(request("partner", "key", time.Now(), "4", body))
+		require.ErrorIs(t, err, ErrTooManyNonces)
+	})
+
+	t.Run("wrong", func(t *testing.T) {
+		tests := map[string]struct {
+			r   *http.Request
+			err error
+		}{
+			"stale":        {r: request("partner", "key", time.Now().Add(-2*time.Minute), "3", body), err: ErrStaleRequest},
+			"future":       {r: request("partner", "key", time.Now().Add(2*time.Minute), "3", body), err: ErrStaleRequest},
+			"wrong key":    {r: request("partner", "other", time.Now(), "3", body), err: ErrWrongSignature},
+			"changed body": {r: request("partner", "key", time.Now(), "3", `{"urls": ["c", "d"]}`), err: ErrWrongSignature},
+			"unknown key":  {r: request("unknown", "key", time.Now(), "3", body), err: ErrUnknownKey},
+			"expired key":  {r: request("expired", "old", time.Now(), "3", body), err: ErrKeyExpired},
+		}
+
+		for name, tt := range tests {
+			_, err := authenticator.Authenticate(tt.r)
+			require.ErrorIs(t, err, tt.err, name)
+		}
+	})
+}
+
+func TestNonceWindow(t *testing.T) {
+	now := time.Now()
+	window := newNonceWindow(2)
+
+	require.NoError(t, window.add("a", now.Add(time.Minute), now))
+	require.ErrorIs(t, window.add("a", now.Add(time.Minute), now), ErrReplayed)
+
+	// expired nonces are accepted again
+	require.NoError(t, window.add("a", now.Add(3*time.Minute), now.Add(2*time.Minute)))
+	now = now.Add(2 * time.Minute)
+
+	// unexpired nonces are never forgotten, new ones are refused while the window is full of them
+	require.NoError(t, window.add("b", now.Add(time.Minute), now))
+	require.ErrorIs(t, window.add("c", now.Add(time.Minute), now), ErrTooManyNonces)
+	require.ErrorIs(t, window.add("b", now.Add(time.Minute), now), ErrReplayed)
+
+	// the nonces are forgotten as they expire
+	require.NoError(t, window.add("c", now.Add(2*time.Minute), now.Add(time.Minute)))
+	require.NoError(t, window.add("d", now.Add(2*time.Minute), now.Add(time.Minute)))
+	require.ErrorIs(t, window.add("c", now.Add(2*time.Minute), now.Add(time.Minute)), ErrReplayed)
+	require.Len(t, window.seen, 2)
+}
@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+// jwtLeeway tolerates the clock skew between the token issuer and the server.
+const jwtLeeway = 30 * time.Second
+
+// Claims limit what the token holder can do, zero MaxURLs means no limit
+// and a missing allowed_features claim allows the default features, review isn't one of them.
+type Claims struct {
+	Subject         string   `json:"sub"`
+	Issuer          string   `json:"iss"`
+	Audience        audience `json:"aud"`
+	ExpiresAt       int64    `json:"exp"`
+	NotBefore       int64    `json:"nbf"`
+	Tenant          string   `json:"tenant"`
+	MaxURLs         int      `json:"max_urls"`
+	AllowedFeatures []string `json:"allowed_features"`
+}
+
+// audience is either a single string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, item := range a {
+		if item == aud {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jwtVerifier verifies HS256 tokens with a shared key and RS256 tokens with public keys found by the key id.
+type jwtVerifier struct {
+	hmacKey  []byte
+	rsaKeys  map[string]*rsa.PublicKey
+	issuer   string
+	audience string
+}
+
+// newJWTVerifier returns nil if there are no keys to verify tokens with.
+func newJWTVerifier(config Config) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		rsaKeys:  make(map[string]*rsa.PublicKey),
+		issuer:   config.GetJWTIssuer(),
+		audience: config.GetJWTAudience(),
+	}
+
+	if file := config.GetJWTHMACKeyFile(); file != "" {
+		key, err := os.ReadFile(file)
+		if err != nil {
+			return nil, wrap.New(ErrJWTKeysRead, err)
+		}
+
+		v.hmacKey = []byte(strings.TrimSpace(string(key)))
+		if len(v.hmacKey) == 0 {
+			return nil, fmt.Errorf("%w: %s is empty", ErrJWTKeysRead, file)
+		}
+	}
+
+	// a key of a pem file is identified by the file name without the extension
+	for _, file := range config.GetJWTPublicKeyFiles() {
+		key, err := readPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+
+		v.rsaKeys[strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))] = key
+	}
+
+	if file := config.GetJWTJWKSFile(); file != "" {
+		keys, err := readJWKS(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for kid, key := range keys {
+			v.rsaKeys[kid] = key
+		}
+	}
+
+	if v.hmacKey == nil && len(v.rsaKeys) == 0 {
+		return nil, nil
+	}
+
+	return v, nil
+}
+
+// looksLikeJWT tells a token from an api key sent in the same Authorization header.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (v *jwtVerifier) verify(token string, now time.Time) (Claims, error) {
+	var claims Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: malformed token", ErrWrongToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: malformed signature", ErrWrongToken)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// the algorithm is checked against the configured keys, so an rsa public key is never used as an hmac secret
+	switch header.Alg {
+	case "HS256":
+		if v.hmacKey == nil {
+			return claims, fmt.Errorf("%w: HS256 tokens aren't accepted", ErrWrongToken)
+		}
+
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return claims, fmt.Errorf("%w: wrong signature", ErrWrongToken)
+		}
+
+	case "RS256":
+		key, err := v.rsaKey(header.Kid)
+		if err != nil {
+			return claims, err
+		}
+
+		hash := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+			return claims, fmt.Errorf("%w: wrong signature", ErrWrongToken)
+		}
+
+	default:
+		return claims, fmt.Errorf("%w: %q algorithm isn't supported", ErrWrongToken, header.Alg)
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+
+	return claims, v.validate(claims, now)
+}
+
+func (v *jwtVerifier) rsaKey(kid string) (*rsa.PublicKey, error) {
+	if key, ok := v.rsaKeys[kid]; ok {
+		return key, nil
+	}
+
+	// a token without a key id is fine while there is the only key
+	if kid == "" && len(v.rsaKeys) == 1 {
+		for _, key := range v.rsaKeys {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unknown key %q", ErrWrongToken, kid)
+}
+
+func (v *jwtVerifier) validate(claims Claims, now time.Time) error {
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("%w: exp claim is required", ErrWrongToken)
+	}
+
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return ErrTokenExpired
+	}
+
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("%w: token isn't valid yet", ErrWrongToken)
+	}
+
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return fmt.Errorf("%w: wrong issuer %q", ErrWrongToken, claims.Issuer)
+	}
+
+	if v.audience != "" && !claims.Audience.contains(v.audience) {
+		return fmt.Errorf("%w: wrong audience", ErrWrongToken)
+	}
+
+	if claims.MaxURLs < 0 {
+		return fmt.Errorf("%w: negative max_urls", ErrWrongToken)
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrWrongToken)
+	}
+
+	if err := json.Unmarshal(content, v); err != nil {
+		return wrap.New(ErrWrongToken, err)
+	}
+
+	return nil
+}
+
+// readPublicKey reads an rsa public key from a pem file, a certificate is fine as well.
+func readPublicKey(file string) (*rsa.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, wrap.New(ErrJWTKeysRead, err)
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %s isn't a pem file", ErrJWTKeysRead, file)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, wrap.New(ErrJWTKeysRead, fmt.Errorf("%s: %w", file, err))
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s isn't an rsa key", ErrJWTKeysRead, file)
+	}
+
+	return rsaKey, nil
+}
+
+// readJWKS reads the rsa keys of a json web key set file, the keys of other types are skipped.
+func readJWKS(file string) (map[string]*rsa.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, wrap.New(ErrJWTKeysRead, err)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, wrap.New(ErrJWTKeysRead, fmt.Errorf("%s: %w", file, err))
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			return nil, fmt.Errorf("%w: %s: malformed key %q", ErrJWTKeysRead, file, k.Kid)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
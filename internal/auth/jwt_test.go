@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encodeToken(t *testing.T, header, claims string, sign func(signed []byte) []byte) string {
+	t.Helper()
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestAuthenticatorJWT(t *testing.T) {
+	dir := t.TempDir()
+
+	hmacKeyFile := filepath.Join(dir, "hmac.key")
+	require.NoError(t, os.WriteFile(hmacKeyFile, []byte("jwt-secret\n"), 0o600))
+
+	pemKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&pemKey.PublicKey)
+	require.NoError(t, err)
+	pemFile := filepath.Join(dir, "first.pem")
+	require.NoError(t, os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	jwksKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "skipped"},
+		{
+			"kty": "RSA",
+			"kid": "second",
+			"n":   base64.RawURLEncoding.EncodeToString(jwksKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(jwksKey.E)).Bytes()),
+		},
+	}})
+	require.NoError(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwks, 0o600))
+
+	authenticator, err := New(fakeConfig{
+		jwtHMACKey:  hmacKeyFile,
+		jwtPEMFiles: []string{pemFile},
+		jwtJWKSFile: jwksFile,
+		jwtAudience: "face_comparison",
+	})
+	require.NoError(t, err)
+
+	hs256 := func(key string) func([]byte) []byte {
+		return func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write(signed)
+			return mac.Sum(nil)
+		}
+	}
+	rs256 := func(key *rsa.PrivateKey) func([]byte) []byte {
+		return func(signed []byte) []byte {
+			hash := sha256.Sum256(signed)
+			signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+			require.NoError(t, err)
+			return signature
+		}
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := fmt.Sprintf(`{"sub": "partner", "aud": ["face_comparison"], "exp": %d, "tenant": "acme", "max_urls": 5, "allowed_features": ["compare"]}`, exp)
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "HS256", token: encodeToken(t, `{"alg": "HS256"}`, claims, hs256("jwt-secret"))},
+		{name: "RS256 pem", token: encodeToken(t, `{"alg": "RS256", "kid": "first"}`, claims, rs256(pemKey))},
+		{name: "RS256 jwks", token: encodeToken(t, `{"alg": "RS256", "kid": "second"}`, claims, rs256(jwksKey))},
+		{name: "wrong hmac key", token: encodeToken(t, `{"alg": "HS256"}`, claims, hs256("other")), err: ErrWrongToken},
+		{name: "wrong rsa key", token: encodeToken(t, `{"alg": "RS256", "kid": "first"}`, claims, rs256(jwksKey)), err: ErrWrongToken},
+		{name: "unknown key id", token: encodeToken(t, `{"alg": "RS256", "kid": "third"}`, claims, rs256(pemKey)), err: ErrWrongToken},
+		{name: "none algorithm", token: encodeToken(t, `{"alg": "none"}`, claims, func([]byte) []byte { return nil }), err: ErrWrongToken},
+		{
+			name:  "expired",
+			token: encodeToken(t, `{"alg": "HS256"}`, fmt.Sprintf(`{"aud": "face_comparison", "exp": %d}`, time.Now().Add(-time.Hour).Unix()), hs256("jwt-secret")),
+			err:   ErrTokenExpired,
+		},
+		{
+			name:  "no expiry",
+			token: encodeToken(t, `{"alg": "HS256"}`, `{"aud": "face_comparison"}`, hs256("jwt-secret")),
+			err:   ErrWrongToken,
+		},
+		{
+			name:  "wrong audience",
+			token: encodeToken(t, `{"alg": "HS256"}`, fmt.Sprintf(`{"aud": "other", "exp": %d}`, exp), hs256("jwt-secret")),
+			err:   ErrWrongToken,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v2/compare/", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+
+			client, err := authenticator.Authenticate(r)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, Client{
+				Name:     "partner",
+				Method:   MethodJWT,
+				Tenant:   "acme",
+				MaxURLs:  5,
+				Features: []string{FeatureCompare},
+			}, client)
+			require.True(t, client.Allows(FeatureCompare))
+			require.False(t, client.Allows(FeatureGender))
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+// Key is a named api key, a zero ExpiresAt means the key never expires.
+// Features are granted to the key holder, the default features are allowed if none are set.
+type Key struct {
+	Name      string    `json:"name"`
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Features  []string  `json:"features"`
+}
+
+func (k Key) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// ParseKeys parses keys given as "name:key" or "name:key:expiry", the expiry is in RFC 3339.
+func ParseKeys(keys []string) ([]Key, error) {
+	parsed := make([]Key, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.SplitN(key, ":", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%w: a name and a key are expected", ErrWrongKey)
+		}
+
+		k := Key{Name: parts[0], Key: parts[1]}
+		if len(parts) == 3 {
+			expiresAt, err := time.Parse(time.RFC3339, parts[2])
+			if err != nil {
+				return nil, wrap.New(ErrWrongKey, fmt.Errorf("%s expiry: %w", k.Name, err))
+			}
+			k.ExpiresAt = expiresAt
+		}
+
+		parsed = append(parsed, k)
+	}
+
+	return parsed, validate(parsed)
+}
+
+// ReadKeys reads a json array of keys from the file.
+func ReadKeys(file string) ([]Key, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, wrap.New(ErrKeysRead, err)
+	}
+
+	var keys []Key
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, wrap.New(ErrKeysRead, fmt.Errorf("%s: %w", file, err))
+	}
+
+	return keys, validate(keys)
+}
+
+func validate(keys []Key) error {
+	for _, k := range keys {
+		if k.Name == "" || k.Key == "" {
+			return fmt.Errorf("%w: a name and a key are expected", ErrWrongKey)
+		}
+
+		for _, feature := range k.Features {
+			if !known(feature) {
+				return fmt.Errorf("%w: %s has unknown feature %q", ErrWrongKey, k.Name, feature)
+			}
+		}
+	}
+
+	return nil
+}
+
+func known(feature string) bool {
+	switch feature {
+	case FeatureCompare, FeatureGender, FeatureReview, FeatureAnalyze:
+		return true
+	}
+
+	return false
+}
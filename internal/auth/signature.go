@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+// Headers of a signed request, the key id is the name of the api key the request is signed with.
+const (
+	HeaderKeyID     = "X-Key-Id"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+// maxSignedBody limits the body read into memory to check its hash.
+const maxSignedBody = 1 << 20
+
+// Sign returns the hex encoded HMAC-SHA256 of the request method, path, unix timestamp, nonce and body hash,
+// separated by new lines.
+func Sign(key, method, path, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signed(r *http.Request) bool {
+	return r.Header.Get(HeaderSignature) != ""
+}
+
+// checkSignature verifies a signed request, the body is read and put back for the handler.
+func (a *Authenticator) checkSignature(r *http.Request, now time.Time) (Client, error) {
+	name := r.Header.Get(HeaderKeyID)
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	if name == "" || timestamp == "" || nonce == "" {
+		return Client{}, fmt.Errorf("%w: %s, %s and %s are required", ErrWrongSignature, HeaderKeyID, HeaderTimestamp, HeaderNonce)
+	}
+
+	key, ok := a.key(name)
+	if !ok {
+		return Client{}, ErrUnknownKey
+	}
+
+	if key.Expired(now) {
+		return Client{}, ErrKeyExpired
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Client{}, fmt.Errorf("%w: wrong timestamp %q", ErrWrongSignature, timestamp)
+	}
+
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-a.maxAge)) || signedAt.After(now.Add(a.maxAge)) {
+		return Client{}, fmt.Errorf("%w: signed at %s", ErrStaleRequest, signedAt.UTC().Format(time.RFC3339))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return Client{}, wrap.New(ErrWrongSignature, fmt.Errorf("unable to read the body: %w", err))
+	}
+	if len(body) > maxSignedBody {
+		return Client{}, fmt.Errorf("%w: the body is more than %d bytes", ErrWrongSignature, maxSignedBody)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := Sign(key.Key, r.Method, r.URL.EscapedPath(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(HeaderSignature))) {
+		return Client{}, ErrWrongSignature
+	}
+
+	// the nonce is remembered only once the signature is valid, so it can't be burnt by somebody else
+	if err := a.nonces.add(name+"\n"+nonce, signedAt.Add(a.maxAge), now); err != nil {
+		return Client{}, err
+	}
+
+	return Client{Name: key.Name, Method: MethodSignature, Features: key.Features}, nil
+}
+
+// nonceWindow remembers the nonces until the requests they came with get stale.
+// It keeps size nonces at most, only the expired ones are forgotten, so no new nonce is accepted while it is full.
+type nonceWindow struct {
+	mu     sync.Mutex
+	size   int
+	seen   map[string]time.Time
+	expiry nonceHeap
+}
+
+func newNonceWindow(size int) *nonceWindow {
+	if size < 1 {
+		size = 1
+	}
+
+	return &nonceWindow{
+		size: size,
+		seen: make(map[string]time.Time, size),
+	}
+}
+
+// add remembers the nonce, it fails if the nonce has been seen already and isn't expired yet,
+// or if the window is full of the unexpired ones.
+func (w *nonceWindow) add(nonce string, expiresAt, now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.expiry) > 0 && !now.Before(w.expiry[0].expiresAt) {
+		delete(w.seen, heap.Pop(&w.expiry).(nonceExpiry).nonce)
+	}
+
+	if _, ok := w.seen[nonce]; ok {
+		return ErrReplayed
+	}
+
+	if len(w.seen) >= w.size {
+		return ErrTooManyNonces
+	}
+
+	w.seen[nonce] = expiresAt
+	heap.Push(&w.expiry, nonceExpiry{nonce: nonce, expiresAt: expiresAt})
+
+	return nil
+}
+
+type nonceExpiry struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// nonceHeap orders the nonces by expiry, the first one expires first.
+type nonceHeap []nonceExpiry
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(nonceExpiry)) }
+
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
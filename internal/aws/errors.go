@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+// Kinds of recognition errors, match them with errors.Is.
+var (
+	ErrThrottled          = errors.New("recognition requests are throttled")
+	ErrBackendUnavailable = errors.New("recognition backend is unavailable")
+	ErrAccessDenied       = errors.New("recognition access denied")
+	ErrImageTooLarge      = errors.New("image is too large for recognition")
+	ErrInvalidImageFormat = errors.New("image format is not supported by recognition")
+	ErrInvalidParameter   = errors.New("invalid recognition parameter")
+	ErrInvalidS3Object    = errors.New("invalid s3 object")
+	ErrNoFace             = errors.New("no face found")
+	ErrBackend            = errors.New("recognition error")
+)
+
+// Error is a failed recognition call.
+// It matches its kind with errors.Is, while the original aws error is available with errors.As.
+type Error struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %s", e.Op, e.Kind)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", e.Op, e.Kind, e.Err)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var kinds = map[string]error{
+	rekognition.ErrCodeThrottlingException:                    ErrThrottled,
+	rekognition.ErrCodeProvisionedThroughputExceededException: ErrThrottled,
+	rekognition.ErrCodeInternalServerError:                    ErrBackendUnavailable,
+	request.ErrCodeRequestError:                               ErrBackendUnavailable,
+	rekognition.ErrCodeAccessDeniedException:                  ErrAccessDenied,
+	rekognition.ErrCodeImageTooLargeException:                 ErrImageTooLarge,
+	rekognition.ErrCodeInvalidImageFormatException:            ErrInvalidImageFormat,
+	rekognition.ErrCodeInvalidParameterException:              ErrInvalidParameter,
+	rekognition.ErrCodeInvalidS3ObjectException:               ErrInvalidS3Object,
+}
+
+// newError classifies an error returned by the aws sdk.
+func newError(op string, err error) *Error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if kind, ok := kinds[aerr.Code()]; ok {
+			return &Error{Op: op, Kind: kind, Err: err}
+		}
+	}
+
+	return &Error{Op: op, Kind: ErrBackend, Err: err}
+}
+
+// IsClientError reports whether the call failed because of the request itself, e.g. an image without faces,
+// rather than because of the backend state.
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrImageTooLarge) ||
+		errors.Is(err, ErrInvalidImageFormat) ||
+		errors.Is(err, ErrInvalidParameter) ||
+		errors.Is(err, ErrInvalidS3Object) ||
+		errors.Is(err, ErrNoFace)
+}
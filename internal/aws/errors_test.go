@@ -0,0 +1,55 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		code   string
+		kind   error
+		client bool
+	}{
+		{code: rekognition.ErrCodeThrottlingException, kind: ErrThrottled},
+		{code: rekognition.ErrCodeProvisionedThroughputExceededException, kind: ErrThrottled},
+		{code: rekognition.ErrCodeInternalServerError, kind: ErrBackendUnavailable},
+		{code: rekognition.ErrCodeAccessDeniedException, kind: ErrAccessDenied},
+		{code: rekognition.ErrCodeImageTooLargeException, kind: ErrImageTooLarge, client: true},
+		{code: rekognition.ErrCodeInvalidImageFormatException, kind: ErrInvalidImageFormat, client: true},
+		{code: rekognition.ErrCodeInvalidParameterException, kind: ErrInvalidParameter, client: true},
+		{code: "SomethingNew", kind: ErrBackend},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.code, func(t *testing.T) {
+			aerr := awserr.New(tt.code, "message", nil)
+
+			// wrapping by callers hides neither the kind nor the original error
+			err := fmt.Errorf("unable to compare: %w", newError("compare faces", aerr))
+			require.ErrorIs(t, err, tt.kind)
+			require.Equal(t, tt.client, IsClientError(err))
+
+			var target awserr.Error
+			require.True(t, errors.As(err, &target))
+			require.Equal(t, tt.code, target.Code())
+
+			var recognitionErr *Error
+			require.True(t, errors.As(err, &recognitionErr))
+			require.Equal(t, "compare faces", recognitionErr.Op)
+		})
+	}
+
+	t.Run("no face", func(t *testing.T) {
+		err := error(&Error{Op: "predict gender", Kind: ErrNoFace})
+		require.ErrorIs(t, err, ErrNoFace)
+		require.True(t, IsClientError(err))
+		require.Equal(t, "predict gender: no face found", err.Error())
+	})
+}
@@ -1,21 +1,21 @@
 package s3
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/rekognition"
-	"github.com/pkg/errors"
+	"github.com/spendmail/face_comparison/internal/face"
 	"strings"
 )
 
 type Config interface {
+	RetryConfig
 	GetAccessKeyId() string
 	GetSecretAccessKey() string
 	GetRegion() string
-	GetSimilarityThreshold() float64
 }
 
 type Logger interface {
@@ -25,26 +25,74 @@ type Logger interface {
 	Error(args ...interface{})
 }
 
+// Backend operations, the throttle limits each of them on its own.
+const (
+	OpCompareFaces = "CompareFaces"
+	OpDetectFaces  = "DetectFaces"
+)
+
+// Throttle is waited on before every call to the backend, the retried ones included.
+type Throttle interface {
+	Wait(ctx context.Context, op string) error
+}
+
 type Client struct {
-	config Config
-	logger Logger
-	svc    *rekognition.Rekognition
+	config   Config
+	logger   Logger
+	svc      *rekognition.Rekognition
+	retrier  *retrier
+	throttle Throttle
 }
 
-func NewRecognitionClient(config Config, logger Logger) (*Client, error) {
+// NewRecognitionClient creates a client, a nil throttle doesn't limit the calls.
+func NewRecognitionClient(config Config, logger Logger, throttle Throttle) (*Client, error) {
 
 	awsConfig := aws.NewConfig()
 	awsConfig.WithCredentials(credentials.NewStaticCredentials(config.GetAccessKeyId(), config.GetSecretAccessKey(), ""))
 	awsConfig.WithRegion(config.GetRegion())
+	// retries are made by the client itself, so they are limited by the attempts number and the time budget
+	awsConfig.WithMaxRetries(0)
 
 	return &Client{
-		config: config,
-		logger: logger,
-		svc:    rekognition.New(session.New(), awsConfig),
+		config:   config,
+		logger:   logger,
+		svc:      rekognition.New(session.New(), awsConfig),
+		retrier:  newRetrier(config),
+		throttle: throttle,
 	}, nil
 }
 
-func (c *Client) PredictGender(source []byte) (string, error) {
+func (c *Client) PredictGender(ctx context.Context, source []byte) (string, error) {
+	details, err := c.detectFaces(ctx, "predict gender", source)
+	if err != nil {
+		return "", err
+	}
+
+	for _, d := range details {
+		if d.Gender != nil && d.Gender.Value != nil {
+			return strings.ToLower(*d.Gender.Value), nil
+		}
+	}
+
+	return "", &Error{Op: "predict gender", Kind: ErrNoFace}
+}
+
+// AnalyzeFaces returns the attributes of every face found on the image, an image without faces isn't an error.
+func (c *Client) AnalyzeFaces(ctx context.Context, source []byte) ([]face.Details, error) {
+	details, err := c.detectFaces(ctx, "analyze faces", source)
+	if err != nil {
+		return nil, err
+	}
+
+	faces := make([]face.Details, 0, len(details))
+	for _, d := range details {
+		faces = append(faces, newDetails(d))
+	}
+
+	return faces, nil
+}
+
+func (c *Client) detectFaces(ctx context.Context, op string, source []byte) ([]*rekognition.FaceDetail, error) {
 
 	attr := "ALL"
 	input := &rekognition.DetectFacesInput{
@@ -54,23 +102,27 @@ func (c *Client) PredictGender(source []byte) (string, error) {
 		},
 	}
 
-	result, err := c.svc.DetectFaces(input)
-
-	if err != nil {
-		return "", fmt.Errorf("unable to predict gender by photo: %w", err)
+	var result *rekognition.DetectFacesOutput
+	attempts, err := c.call(ctx, OpDetectFaces, op, func(ctx context.Context) (err error) {
+		result, err = c.svc.DetectFacesWithContext(ctx, input)
+		return err
+	})
+	if attempts > 1 {
+		c.logger.Debug(fmt.Sprintf("%s made in %d attempts", op, attempts))
 	}
 
-	for _, details := range result.FaceDetails {
-		return strings.ToLower(*details.Gender.Value), nil
+	if err != nil {
+		return nil, err
 	}
 
-	return "", errors.New("unable to predict gender by photo")
+	return result.FaceDetails, nil
 }
 
-func (c *Client) CompareFaces(source, target []byte) (int, int, error) {
+func (c *Client) CompareFaces(ctx context.Context, source, target []byte) (face.Comparison, error) {
 
+	// Requesting similarities of all the faces, the application decides on its own which of them match.
 	input := &rekognition.CompareFacesInput{
-		SimilarityThreshold: aws.Float64(c.config.GetSimilarityThreshold()),
+		SimilarityThreshold: aws.Float64(0),
 		SourceImage: &rekognition.Image{
 			Bytes: source,
 		},
@@ -79,36 +131,152 @@ func (c *Client) CompareFaces(source, target []byte) (int, int, error) {
 		},
 	}
 
-	result, err := c.svc.CompareFaces(input)
-	unmatchedFacesCnt := len(result.UnmatchedFaces)
-	matchedFacesCnt := len(result.FaceMatches)
+	var result *rekognition.CompareFacesOutput
+	attempts, err := c.call(ctx, OpCompareFaces, "compare faces", func(ctx context.Context) (err error) {
+		result, err = c.svc.CompareFacesWithContext(ctx, input)
+		return err
+	})
+	comparison := newComparison(result)
+	comparison.Attempts = attempts
 
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case rekognition.ErrCodeInvalidParameterException:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeInvalidParameterException, aerr)
-			case rekognition.ErrCodeInvalidS3ObjectException:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeInvalidS3ObjectException, aerr)
-			case rekognition.ErrCodeImageTooLargeException:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeImageTooLargeException, aerr)
-			case rekognition.ErrCodeAccessDeniedException:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeAccessDeniedException, aerr)
-			case rekognition.ErrCodeInternalServerError:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeInternalServerError, aerr)
-			case rekognition.ErrCodeThrottlingException:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeThrottlingException, aerr)
-			case rekognition.ErrCodeProvisionedThroughputExceededException:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeProvisionedThroughputExceededException, aerr)
-			case rekognition.ErrCodeInvalidImageFormatException:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("%s: %w", rekognition.ErrCodeInvalidImageFormatException, aerr)
-			default:
-				return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("compare faces error: %w", aerr)
+	return comparison, err
+}
+
+// call makes the backend call with retries, waiting for the throttle before every attempt.
+// A throttle error is returned as it is, the backend ones are wrapped into Error.
+func (c *Client) call(ctx context.Context, api, op string, fn func(ctx context.Context) error) (int, error) {
+	var throttled error
+	attempts, err := c.retrier.do(ctx, func(ctx context.Context) error {
+		if c.throttle != nil {
+			if throttled = c.throttle.Wait(ctx, api); throttled != nil {
+				return throttled
 			}
-		} else {
-			return unmatchedFacesCnt, matchedFacesCnt, fmt.Errorf("compare faces error: %w", err)
+		}
+
+		return fn(ctx)
+	})
+
+	switch {
+	case err == nil:
+		return attempts, nil
+	case throttled != nil:
+		return attempts, throttled
+	default:
+		return attempts, newError(op, err)
+	}
+}
+
+func newComparison(output *rekognition.CompareFacesOutput) face.Comparison {
+	comparison := face.Comparison{
+		Matches:        make([]face.Match, 0),
+		UnmatchedFaces: make([]face.Match, 0),
+	}
+
+	if output == nil {
+		return comparison
+	}
+
+	if output.SourceImageFace != nil {
+		comparison.SourceFace = newFace(output.SourceImageFace.BoundingBox, output.SourceImageFace.Confidence)
+	}
+
+	for _, match := range output.FaceMatches {
+		m := face.Match{Similarity: aws.Float64Value(match.Similarity)}
+		if match.Face != nil {
+			m.Face = newFace(match.Face.BoundingBox, match.Face.Confidence)
+		}
+		comparison.Matches = append(comparison.Matches, m)
+	}
+
+	for _, unmatched := range output.UnmatchedFaces {
+		comparison.UnmatchedFaces = append(comparison.UnmatchedFaces, face.Match{Face: newFace(unmatched.BoundingBox, unmatched.Confidence)})
+	}
+
+	return comparison
+}
+
+func newFace(box *rekognition.BoundingBox, confidence *float64) face.Face {
+	f := face.Face{Confidence: aws.Float64Value(confidence)}
+	if box != nil {
+		f.BoundingBox = face.BoundingBox{
+			Left:   aws.Float64Value(box.Left),
+			Top:    aws.Float64Value(box.Top),
+			Width:  aws.Float64Value(box.Width),
+			Height: aws.Float64Value(box.Height),
+		}
+	}
+
+	return f
+}
+
+func newDetails(d *rekognition.FaceDetail) face.Details {
+	details := face.Details{
+		Face:     newFace(d.BoundingBox, d.Confidence),
+		Emotions: make([]face.Emotion, 0, len(d.Emotions)),
+	}
+
+	if d.AgeRange != nil {
+		details.AgeRange = face.AgeRange{
+			Low:  int(aws.Int64Value(d.AgeRange.Low)),
+			High: int(aws.Int64Value(d.AgeRange.High)),
+		}
+	}
+
+	if d.Gender != nil {
+		details.Gender = face.Gender{
+			Value:      strings.ToLower(aws.StringValue(d.Gender.Value)),
+			Confidence: aws.Float64Value(d.Gender.Confidence),
 		}
 	}
 
-	return unmatchedFacesCnt, matchedFacesCnt, nil
+	for _, emotion := range d.Emotions {
+		details.Emotions = append(details.Emotions, face.Emotion{
+			Type:       strings.ToLower(aws.StringValue(emotion.Type)),
+			Confidence: aws.Float64Value(emotion.Confidence),
+		})
+	}
+
+	// the sdk has a type of its own for every yes/no attribute
+	if d.Smile != nil {
+		details.Smile = newAttribute(d.Smile.Value, d.Smile.Confidence)
+	}
+	if d.Eyeglasses != nil {
+		details.Eyeglasses = newAttribute(d.Eyeglasses.Value, d.Eyeglasses.Confidence)
+	}
+	if d.Sunglasses != nil {
+		details.Sunglasses = newAttribute(d.Sunglasses.Value, d.Sunglasses.Confidence)
+	}
+	if d.Beard != nil {
+		details.Beard = newAttribute(d.Beard.Value, d.Beard.Confidence)
+	}
+	if d.Mustache != nil {
+		details.Mustache = newAttribute(d.Mustache.Value, d.Mustache.Confidence)
+	}
+	if d.EyesOpen != nil {
+		details.EyesOpen = newAttribute(d.EyesOpen.Value, d.EyesOpen.Confidence)
+	}
+	if d.MouthOpen != nil {
+		details.MouthOpen = newAttribute(d.MouthOpen.Value, d.MouthOpen.Confidence)
+	}
+
+	if d.Pose != nil {
+		details.Pose = face.Pose{
+			Roll:  aws.Float64Value(d.Pose.Roll),
+			Yaw:   aws.Float64Value(d.Pose.Yaw),
+			Pitch: aws.Float64Value(d.Pose.Pitch),
+		}
+	}
+
+	if d.Quality != nil {
+		details.Quality = face.Quality{
+			Brightness: aws.Float64Value(d.Quality.Brightness),
+			Sharpness:  aws.Float64Value(d.Quality.Sharpness),
+		}
+	}
+
+	return details
+}
+
+func newAttribute(value *bool, confidence *float64) face.Attribute {
+	return face.Attribute{Value: aws.BoolValue(value), Confidence: aws.Float64Value(confidence)}
 }
@@ -0,0 +1,62 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/spendmail/face_comparison/internal/face"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDetails(t *testing.T) {
+	t.Run("all attributes", func(t *testing.T) {
+		details := newDetails(&rekognition.FaceDetail{
+			BoundingBox: &rekognition.BoundingBox{Left: aws.Float64(0.1), Top: aws.Float64(0.2), Width: aws.Float64(0.3), Height: aws.Float64(0.4)},
+			Confidence:  aws.Float64(99.9),
+			AgeRange:    &rekognition.AgeRange{Low: aws.Int64(25), High: aws.Int64(35)},
+			Gender:      &rekognition.Gender{Value: aws.String("Female"), Confidence: aws.Float64(98)},
+			Emotions: []*rekognition.Emotion{
+				{Type: aws.String("HAPPY"), Confidence: aws.Float64(90)},
+				{Type: aws.String("CALM"), Confidence: aws.Float64(5)},
+			},
+			Smile:      &rekognition.Smile{Value: aws.Bool(true), Confidence: aws.Float64(97)},
+			Eyeglasses: &rekognition.Eyeglasses{Value: aws.Bool(true), Confidence: aws.Float64(96)},
+			Sunglasses: &rekognition.Sunglasses{Value: aws.Bool(false), Confidence: aws.Float64(95)},
+			Beard:      &rekognition.Beard{Value: aws.Bool(false), Confidence: aws.Float64(94)},
+			Mustache:   &rekognition.Mustache{Value: aws.Bool(false), Confidence: aws.Float64(93)},
+			EyesOpen:   &rekognition.EyeOpen{Value: aws.Bool(true), Confidence: aws.Float64(92)},
+			MouthOpen:  &rekognition.MouthOpen{Value: aws.Bool(true), Confidence: aws.Float64(91)},
+			Pose:       &rekognition.Pose{Roll: aws.Float64(1), Yaw: aws.Float64(-2), Pitch: aws.Float64(3)},
+			Quality:    &rekognition.ImageQuality{Brightness: aws.Float64(80), Sharpness: aws.Float64(70)},
+		})
+
+		require.Equal(t, face.Details{
+			Face: face.Face{
+				BoundingBox: face.BoundingBox{Left: 0.1, Top: 0.2, Width: 0.3, Height: 0.4},
+				Confidence:  99.9,
+			},
+			AgeRange:   face.AgeRange{Low: 25, High: 35},
+			Gender:     face.Gender{Value: "female", Confidence: 98},
+			Emotions:   []face.Emotion{{Type: "happy", Confidence: 90}, {Type: "calm", Confidence: 5}},
+			Smile:      face.Attribute{Value: true, Confidence: 97},
+			Eyeglasses: face.Attribute{Value: true, Confidence: 96},
+			Sunglasses: face.Attribute{Value: false, Confidence: 95},
+			Beard:      face.Attribute{Value: false, Confidence: 94},
+			Mustache:   face.Attribute{Value: false, Confidence: 93},
+			EyesOpen:   face.Attribute{Value: true, Confidence: 92},
+			MouthOpen:  face.Attribute{Value: true, Confidence: 91},
+			Pose:       face.Pose{Roll: 1, Yaw: -2, Pitch: 3},
+			Quality:    face.Quality{Brightness: 80, Sharpness: 70},
+		}, details)
+	})
+
+	t.Run("missing attributes", func(t *testing.T) {
+		details := newDetails(&rekognition.FaceDetail{Confidence: aws.Float64(50)})
+
+		require.Equal(t, 50.0, details.Confidence)
+		require.Empty(t, details.Emotions)
+		require.NotNil(t, details.Emotions)
+		require.Equal(t, face.Attribute{}, details.Smile)
+	})
+}
@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+type RetryConfig interface {
+	GetMaxAttempts() int
+	GetRetryBaseDelay() time.Duration
+	GetRetryMaxDelay() time.Duration
+	GetRetryBudget() time.Duration
+}
+
+// retryableCodes are the errors caused by the backend load rather than by the request itself.
+var retryableCodes = map[string]bool{
+	rekognition.ErrCodeThrottlingException:                    true,
+	rekognition.ErrCodeProvisionedThroughputExceededException: true,
+	rekognition.ErrCodeInternalServerError:                    true,
+}
+
+// retrier repeats a call failed with a retryable error, waiting longer after every attempt.
+type retrier struct {
+	config RetryConfig
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newRetrier(config RetryConfig) *retrier {
+	return &retrier{
+		config: config,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// do calls fn until it succeeds, fails with a non-retryable error, runs out of attempts or the time budget.
+// It returns the number of attempts made along with the last error.
+func (r *retrier) do(ctx context.Context, fn func(ctx context.Context) error) (int, error) {
+	if budget := r.config.GetRetryBudget(); budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+
+	attempts := 0
+	for {
+		attempts++
+
+		err := fn(ctx)
+		if err == nil || !isRetryable(err) || attempts >= r.config.GetMaxAttempts() {
+			return attempts, err
+		}
+
+		// there is no point in waiting if the budget runs out before the next attempt
+		delay := r.backoff(attempts)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return attempts, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random delay between zero and the exponentially growing cap, aka full jitter.
+func (r *retrier) backoff(attempt int) time.Duration {
+	limit := r.config.GetRetryBaseDelay()
+	for i := 1; i < attempt && limit < r.config.GetRetryMaxDelay(); i++ {
+		limit *= 2
+	}
+
+	if limit > r.config.GetRetryMaxDelay() {
+		limit = r.config.GetRetryMaxDelay()
+	}
+
+	if limit <= 0 {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return time.Duration(r.rand.Int63n(int64(limit) + 1))
+}
+
+func isRetryable(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && retryableCodes[aerr.Code()]
+}
@@ -0,0 +1,148 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/stretchr/testify/require"
+)
+
+type retryConfig struct {
+	maxAttempts int
+	budget      time.Duration
+}
+
+func (c retryConfig) GetMaxAttempts() int              { return c.maxAttempts }
+func (c retryConfig) GetRetryBaseDelay() time.Duration { return 10 * time.Millisecond }
+func (c retryConfig) GetRetryMaxDelay() time.Duration  { return 40 * time.Millisecond }
+func (c retryConfig) GetRetryBudget() time.Duration    { return c.budget }
+
+func TestRetrier(t *testing.T) {
+	throttled := awserr.New(rekognition.ErrCodeThrottlingException, "slow down", nil)
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		r := newRetrier(retryConfig{maxAttempts: 5, budget: time.Second})
+
+		calls := 0
+		attempts, err := r.do(context.Background(), func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return throttled
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("runs out of attempts", func(t *testing.T) {
+		r := newRetrier(retryConfig{maxAttempts: 3, budget: time.Second})
+
+		attempts, err := r.do(context.Background(), func(ctx context.Context) error {
+			return throttled
+		})
+		require.ErrorIs(t, err, throttled)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("non-retryable error", func(t *testing.T) {
+		r := newRetrier(retryConfig{maxAttempts: 3, budget: time.Second})
+
+		invalid := awserr.New(rekognition.ErrCodeInvalidParameterException, "no face", nil)
+		attempts, err := r.do(context.Background(), func(ctx context.Context) error {
+			return invalid
+		})
+		require.ErrorIs(t, err, invalid)
+		require.Equal(t, 1, attempts)
+
+		attempts, _ = r.do(context.Background(), func(ctx context.Context) error {
+			return errors.New("network is unreachable")
+		})
+		require.Equal(t, 1, attempts)
+	})
+
+	t.Run("runs out of budget", func(t *testing.T) {
+		r := newRetrier(retryConfig{maxAttempts: 100, budget: 100 * time.Millisecond})
+
+		start := time.Now()
+		_, err := r.do(context.Background(), func(ctx context.Context) error {
+			return throttled
+		})
+		require.ErrorIs(t, err, throttled)
+		require.Less(t, time.Since(start), 150*time.Millisecond)
+	})
+
+	t.Run("backoff stays within limits", func(t *testing.T) {
+		r := newRetrier(retryConfig{})
+
+		for attempt := 1; attempt < 100; attempt++ {
+			delay := r.backoff(attempt)
+			require.GreaterOrEqual(t, delay, time.Duration(0))
+			require.LessOrEqual(t, delay, 40*time.Millisecond)
+		}
+	})
+}
+
+// countingThrottle fails the call once it has been waited on limit times.
+type countingThrottle struct {
+	ops   []string
+	limit int
+}
+
+var errThrottled = errors.New("rate limited")
+
+func (t *countingThrottle) Wait(ctx context.Context, op string) error {
+	if len(t.ops) >= t.limit {
+		return errThrottled
+	}
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+func TestClientCallThrottle(t *testing.T) {
+	throttled := awserr.New(rekognition.ErrCodeThrottlingException, "slow down", nil)
+
+	t.Run("every attempt waits", func(t *testing.T) {
+		throttle := &countingThrottle{limit: 10}
+		c := &Client{retrier: newRetrier(retryConfig{maxAttempts: 5, budget: time.Second}), throttle: throttle}
+
+		calls := 0
+		attempts, err := c.call(context.Background(), OpCompareFaces, "compare faces", func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return throttled
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, attempts)
+		require.Equal(t, []string{OpCompareFaces, OpCompareFaces, OpCompareFaces}, throttle.ops)
+	})
+
+	t.Run("throttle error stops the retries", func(t *testing.T) {
+		throttle := &countingThrottle{limit: 1}
+		c := &Client{retrier: newRetrier(retryConfig{maxAttempts: 5, budget: time.Second}), throttle: throttle}
+
+		calls := 0
+		attempts, err := c.call(context.Background(), OpDetectFaces, "predict gender", func(ctx context.Context) error {
+			calls++
+			return throttled
+		})
+		require.ErrorIs(t, err, errThrottled)
+		require.Equal(t, 2, attempts)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("backend errors are typed", func(t *testing.T) {
+		c := &Client{retrier: newRetrier(retryConfig{maxAttempts: 1, budget: time.Second})}
+
+		_, err := c.call(context.Background(), OpDetectFaces, "predict gender", func(ctx context.Context) error {
+			return throttled
+		})
+		require.ErrorIs(t, err, ErrThrottled)
+	})
+}
@@ -2,18 +2,31 @@ package config
 
 import (
 	"fmt"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
-var ErrConfigRead = errors.New("unable to read config file")
+var (
+	ErrConfigRead    = errors.New("unable to read config file")
+	ErrConfigInvalid = errors.New("invalid config")
+)
 
 type Config struct {
-	Logger LoggerConf
-	HTTP   HTTPConf
-	AWS    AWSConf
+	Logger     LoggerConf
+	HTTP       HTTPConf
+	AWS        AWSConf
+	Review     ReviewConf
+	Workers    WorkersConf
+	Downloader DownloaderConf
+	Breaker    BreakerConf
+	Auth       AuthConf
+	Limits     LimitsConf
+	Jobs       JobsConf
+	Webhook    WebhookConf
+	Batch      BatchConf
 }
 
 type LoggerConf struct {
@@ -30,6 +43,14 @@ type HTTPConf struct {
 	Secret                 string
 	HealthCheckRouteTpl    string
 	FaceComparisonRouteTpl string
+	// v2 of the comparison api, FaceComparisonRouteTpl serves v1
+	FaceComparisonV2RouteTpl string
+	ReviewRouteTpl           string
+	JobsRouteTpl             string
+	BatchRouteTpl            string
+	AnalyzeRouteTpl          string
+	// AlwaysOK keeps the legacy behaviour of answering 200 OK to any v1 comparison request, it is on by default
+	AlwaysOK bool
 }
 
 type AWSConf struct {
@@ -37,18 +58,173 @@ type AWSConf struct {
 	SecretAccessKey     string
 	Region              string
 	SimilarityThreshold float64
+	BorderlineThreshold float64
+
+	// retries of throttled and failed backend calls
+	MaxAttempts    int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	RetryBudget    time.Duration
+
+	// process-wide calls per second and bursts, zero rate means no limit
+	CompareFacesRate  float64
+	CompareFacesBurst int
+	DetectFacesRate   float64
+	DetectFacesBurst  int
+	RateLimitWait     time.Duration
+}
+
+// ReviewConf keeps the reviewed items for the retention period, zero retention keeps them forever.
+type ReviewConf struct {
+	File      string
+	Retention time.Duration
+}
+
+// WorkersConf limits the number of simultaneous downloads and comparisons, an explicit zero means no limit.
+type WorkersConf struct {
+	Download        int
+	DownloadRequest int
+	Compare         int
+	CompareRequest  int
+}
+
+// AuthConf lists the api keys as "name:key" or "name:key:expiry" along with a json file of them.
+// QuerySecret keeps the deprecated secret query parameter working.
+type AuthConf struct {
+	APIKeys     []string
+	APIKeysFile string
+	QuerySecret bool
+
+	// requests signed with an api key, the nonces are remembered for the signature max age
+	SignedRequests  bool
+	SignatureMaxAge time.Duration
+	NonceWindow     int
+
+	// bearer jwt tokens, HS256 ones are verified with the hmac key, RS256 ones with the pem files and the jwks
+	JWTHMACKeyFile    string
+	JWTPublicKeyFiles []string
+	JWTJWKSFile       string
+	JWTIssuer         string
+	JWTAudience       string
+}
+
+// LimitsConf limits every client by its api key or ip address, zero limits mean no limit.
+// The daily usage is dumped to the file every flush interval.
+type LimitsConf struct {
+	By            string
+	RequestsRate  float64
+	RequestsBurst int
+	ImagesPerDay  int
+	File          string
+	FlushInterval time.Duration
+}
+
+// JobsConf limits the background comparisons, finished jobs are kept for the result ttl.
+type JobsConf struct {
+	Workers   int
+	QueueSize int
+	ResultTTL time.Duration
+}
+
+// WebhookConf describes the job callbacks, the payloads are signed with the secret
+// and the failed deliveries are retried from the outbox file.
+type WebhookConf struct {
+	Secret      string
+	OutboxFile  string
+	Timeout     time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Workers     int
+	// the callback urls are checked against these lists, the downloader ones don't apply to them
+	AllowedNetworks []string
+	AllowedDomains  []string
+	DeniedDomains   []string
+}
+
+// BatchConf limits the sets of a batch request and the number of them compared at once.
+type BatchConf struct {
+	MaxSets int
+	Workers int
+}
+
+// BreakerConf describes when the recognition backend is considered degraded.
+type BreakerConf struct {
+	FailureRate      float64
+	Window           int
+	MinRequests      int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+type DownloaderConf struct {
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	MaxSize        int64
+	MaxRedirects   int
+
+	// non-public networks the downloader may connect to, and domains lists
+	AllowedNetworks []string
+	AllowedDomains  []string
+	DeniedDomains   []string
 }
 
 func New(path string) (*Config, error) {
 	viper.SetConfigFile(path)
 
+	viper.SetDefault("http.face_comparison_v2_route_tpl", "/v2/compare/")
+	viper.SetDefault("http.always_ok", true)
+	viper.SetDefault("http.review_route_tpl", "/review/")
+	viper.SetDefault("aws.similarity_threshold", 80)
+	viper.SetDefault("review.retention", 30*24*time.Hour)
+	viper.SetDefault("workers.download", 100)
+	viper.SetDefault("workers.download_request", 10)
+	viper.SetDefault("workers.compare", 20)
+	viper.SetDefault("workers.compare_request", 5)
+	viper.SetDefault("downloader.connect_timeout", 5*time.Second)
+	viper.SetDefault("downloader.read_timeout", 30*time.Second)
+	viper.SetDefault("downloader.max_size", 5*1024*1024)
+	viper.SetDefault("downloader.max_redirects", 5)
+	viper.SetDefault("aws.max_attempts", 3)
+	viper.SetDefault("aws.retry_base_delay", 100*time.Millisecond)
+	viper.SetDefault("aws.retry_max_delay", 2*time.Second)
+	viper.SetDefault("aws.retry_budget", 10*time.Second)
+	viper.SetDefault("breaker.window", 20)
+	viper.SetDefault("breaker.min_requests", 10)
+	viper.SetDefault("breaker.open_timeout", 30*time.Second)
+	viper.SetDefault("breaker.half_open_requests", 1)
+	viper.SetDefault("auth.query_secret", true)
+	viper.SetDefault("limits.by", "key")
+	viper.SetDefault("http.jobs_route_tpl", "/jobs/")
+	viper.SetDefault("jobs.workers", 4)
+	viper.SetDefault("jobs.queue_size", 100)
+	viper.SetDefault("jobs.result_ttl", time.Hour)
+	viper.SetDefault("webhook.timeout", 10*time.Second)
+	viper.SetDefault("http.batch_route_tpl", "/v2/batch/")
+	viper.SetDefault("http.analyze_route_tpl", "/analyze/")
+	viper.SetDefault("batch.max_sets", 1000)
+	viper.SetDefault("batch.workers", 4)
+	viper.SetDefault("webhook.max_attempts", 10)
+	viper.SetDefault("webhook.backoff", 5*time.Second)
+	viper.SetDefault("webhook.max_backoff", 10*time.Minute)
+	viper.SetDefault("webhook.workers", 4)
+	viper.SetDefault("limits.flush_interval", 10*time.Second)
+	viper.SetDefault("auth.signature_max_age", 5*time.Minute)
+	viper.SetDefault("auth.nonce_window", 100000)
+
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrConfigRead, path)
 	}
 
-	st, err := strconv.Atoi(viper.GetString("aws.similarity_threshold"))
-	if err != nil {
-		st = 80
+	// the borderline bucket lies below the similarity threshold, zero borderline threshold disables it
+	st, bt := viper.GetFloat64("aws.similarity_threshold"), viper.GetFloat64("aws.borderline_threshold")
+	if st <= 0 || st > 100 || bt < 0 || bt >= st {
+		return nil, fmt.Errorf("%w: aws.similarity_threshold %v, aws.borderline_threshold %v", ErrConfigInvalid, st, bt)
+	}
+
+	// the review routes are registered under this prefix, the root one would shadow the other routes
+	if strings.Trim(viper.GetString("http.review_route_tpl"), "/") == "" {
+		return nil, fmt.Errorf("%w: empty http.review_route_tpl", ErrConfigInvalid)
 	}
 
 	return &Config{
@@ -65,12 +241,96 @@ func New(path string) (*Config, error) {
 			viper.GetString("http.secret"),
 			viper.GetString("http.health_check_route_tpl"),
 			viper.GetString("http.face_comparison_route_tpl"),
+			viper.GetString("http.face_comparison_v2_route_tpl"),
+			viper.GetString("http.review_route_tpl"),
+			viper.GetString("http.jobs_route_tpl"),
+			viper.GetString("http.batch_route_tpl"),
+			viper.GetString("http.analyze_route_tpl"),
+			viper.GetBool("http.always_ok"),
 		},
 		AWSConf{
 			viper.GetString("aws.access_key_id"),
 			viper.GetString("aws.secret_access_key"),
 			viper.GetString("aws.region"),
-			float64(st),
+			st,
+			bt,
+			viper.GetInt("aws.max_attempts"),
+			viper.GetDuration("aws.retry_base_delay"),
+			viper.GetDuration("aws.retry_max_delay"),
+			viper.GetDuration("aws.retry_budget"),
+			viper.GetFloat64("aws.compare_faces_rate"),
+			viper.GetInt("aws.compare_faces_burst"),
+			viper.GetFloat64("aws.detect_faces_rate"),
+			viper.GetInt("aws.detect_faces_burst"),
+			viper.GetDuration("aws.rate_limit_wait"),
+		},
+		ReviewConf{
+			viper.GetString("review.file"),
+			viper.GetDuration("review.retention"),
+		},
+		WorkersConf{
+			viper.GetInt("workers.download"),
+			viper.GetInt("workers.download_request"),
+			viper.GetInt("workers.compare"),
+			viper.GetInt("workers.compare_request"),
+		},
+		DownloaderConf{
+			viper.GetDuration("downloader.connect_timeout"),
+			viper.GetDuration("downloader.read_timeout"),
+			viper.GetInt64("downloader.max_size"),
+			viper.GetInt("downloader.max_redirects"),
+			viper.GetStringSlice("downloader.allowed_networks"),
+			viper.GetStringSlice("downloader.allowed_domains"),
+			viper.GetStringSlice("downloader.denied_domains"),
+		},
+		BreakerConf{
+			viper.GetFloat64("breaker.failure_rate"),
+			viper.GetInt("breaker.window"),
+			viper.GetInt("breaker.min_requests"),
+			viper.GetDuration("breaker.open_timeout"),
+			viper.GetInt("breaker.half_open_requests"),
+		},
+		AuthConf{
+			viper.GetStringSlice("auth.api_keys"),
+			viper.GetString("auth.api_keys_file"),
+			viper.GetBool("auth.query_secret"),
+			viper.GetBool("auth.signed_requests"),
+			viper.GetDuration("auth.signature_max_age"),
+			viper.GetInt("auth.nonce_window"),
+			viper.GetString("auth.jwt_hmac_key_file"),
+			viper.GetStringSlice("auth.jwt_public_key_files"),
+			viper.GetString("auth.jwt_jwks_file"),
+			viper.GetString("auth.jwt_issuer"),
+			viper.GetString("auth.jwt_audience"),
+		},
+		LimitsConf{
+			viper.GetString("limits.by"),
+			viper.GetFloat64("limits.requests_rate"),
+			viper.GetInt("limits.requests_burst"),
+			viper.GetInt("limits.images_per_day"),
+			viper.GetString("limits.file"),
+			viper.GetDuration("limits.flush_interval"),
+		},
+		JobsConf{
+			viper.GetInt("jobs.workers"),
+			viper.GetInt("jobs.queue_size"),
+			viper.GetDuration("jobs.result_ttl"),
+		},
+		WebhookConf{
+			viper.GetString("webhook.secret"),
+			viper.GetString("webhook.outbox_file"),
+			viper.GetDuration("webhook.timeout"),
+			viper.GetInt("webhook.max_attempts"),
+			viper.GetDuration("webhook.backoff"),
+			viper.GetDuration("webhook.max_backoff"),
+			viper.GetInt("webhook.workers"),
+			viper.GetStringSlice("webhook.allowed_networks"),
+			viper.GetStringSlice("webhook.allowed_domains"),
+			viper.GetStringSlice("webhook.denied_domains"),
+		},
+		BatchConf{
+			viper.GetInt("batch.max_sets"),
+			viper.GetInt("batch.workers"),
 		},
 	}, nil
 }
@@ -95,6 +355,74 @@ func (c *Config) GetSecret() string {
 	return c.HTTP.Secret
 }
 
+func (c *Config) GetAPIKeys() []string {
+	return c.Auth.APIKeys
+}
+
+func (c *Config) GetAPIKeysFile() string {
+	return c.Auth.APIKeysFile
+}
+
+func (c *Config) GetQuerySecret() bool {
+	return c.Auth.QuerySecret
+}
+
+func (c *Config) GetSignedRequests() bool {
+	return c.Auth.SignedRequests
+}
+
+func (c *Config) GetSignatureMaxAge() time.Duration {
+	return c.Auth.SignatureMaxAge
+}
+
+func (c *Config) GetNonceWindow() int {
+	return c.Auth.NonceWindow
+}
+
+func (c *Config) GetJWTHMACKeyFile() string {
+	return c.Auth.JWTHMACKeyFile
+}
+
+func (c *Config) GetJWTPublicKeyFiles() []string {
+	return c.Auth.JWTPublicKeyFiles
+}
+
+func (c *Config) GetJWTJWKSFile() string {
+	return c.Auth.JWTJWKSFile
+}
+
+func (c *Config) GetJWTIssuer() string {
+	return c.Auth.JWTIssuer
+}
+
+func (c *Config) GetJWTAudience() string {
+	return c.Auth.JWTAudience
+}
+
+func (c *Config) GetLimitBy() string {
+	return c.Limits.By
+}
+
+func (c *Config) GetRequestsRate() float64 {
+	return c.Limits.RequestsRate
+}
+
+func (c *Config) GetRequestsBurst() int {
+	return c.Limits.RequestsBurst
+}
+
+func (c *Config) GetImagesPerDay() int {
+	return c.Limits.ImagesPerDay
+}
+
+func (c *Config) GetQuotaFile() string {
+	return c.Limits.File
+}
+
+func (c *Config) GetQuotaFlushInterval() time.Duration {
+	return c.Limits.FlushInterval
+}
+
 func (c *Config) GetHealthCheckRouteTpl() string {
 	return c.HTTP.HealthCheckRouteTpl
 }
@@ -103,6 +431,90 @@ func (c *Config) GetFaceComparisonRouteTpl() string {
 	return c.HTTP.FaceComparisonRouteTpl
 }
 
+func (c *Config) GetFaceComparisonV2RouteTpl() string {
+	return c.HTTP.FaceComparisonV2RouteTpl
+}
+
+func (c *Config) GetReviewRouteTpl() string {
+	return c.HTTP.ReviewRouteTpl
+}
+
+func (c *Config) GetAlwaysOK() bool {
+	return c.HTTP.AlwaysOK
+}
+
+func (c *Config) GetJobsRouteTpl() string {
+	return c.HTTP.JobsRouteTpl
+}
+
+func (c *Config) GetBatchRouteTpl() string {
+	return c.HTTP.BatchRouteTpl
+}
+
+func (c *Config) GetAnalyzeRouteTpl() string {
+	return c.HTTP.AnalyzeRouteTpl
+}
+
+func (c *Config) GetBatchMaxSets() int {
+	return c.Batch.MaxSets
+}
+
+func (c *Config) GetBatchWorkers() int {
+	return c.Batch.Workers
+}
+
+func (c *Config) GetJobWorkers() int {
+	return c.Jobs.Workers
+}
+
+func (c *Config) GetJobQueueSize() int {
+	return c.Jobs.QueueSize
+}
+
+func (c *Config) GetJobResultTTL() time.Duration {
+	return c.Jobs.ResultTTL
+}
+
+func (c *Config) GetWebhookSecret() string {
+	return c.Webhook.Secret
+}
+
+func (c *Config) GetWebhookOutboxFile() string {
+	return c.Webhook.OutboxFile
+}
+
+func (c *Config) GetWebhookTimeout() time.Duration {
+	return c.Webhook.Timeout
+}
+
+func (c *Config) GetWebhookMaxAttempts() int {
+	return c.Webhook.MaxAttempts
+}
+
+func (c *Config) GetWebhookBackoff() time.Duration {
+	return c.Webhook.Backoff
+}
+
+func (c *Config) GetWebhookMaxBackoff() time.Duration {
+	return c.Webhook.MaxBackoff
+}
+
+func (c *Config) GetWebhookWorkers() int {
+	return c.Webhook.Workers
+}
+
+func (c *Config) GetWebhookAllowedNetworks() []string {
+	return c.Webhook.AllowedNetworks
+}
+
+func (c *Config) GetWebhookAllowedDomains() []string {
+	return c.Webhook.AllowedDomains
+}
+
+func (c *Config) GetWebhookDeniedDomains() []string {
+	return c.Webhook.DeniedDomains
+}
+
 func (c *Config) GetAccessKeyId() string {
 	return c.AWS.AccessKeyId
 }
@@ -118,3 +530,115 @@ func (c *Config) GetRegion() string {
 func (c *Config) GetSimilarityThreshold() float64 {
 	return c.AWS.SimilarityThreshold
 }
+
+func (c *Config) GetBorderlineThreshold() float64 {
+	return c.AWS.BorderlineThreshold
+}
+
+func (c *Config) GetMaxAttempts() int {
+	return c.AWS.MaxAttempts
+}
+
+func (c *Config) GetRetryBaseDelay() time.Duration {
+	return c.AWS.RetryBaseDelay
+}
+
+func (c *Config) GetRetryMaxDelay() time.Duration {
+	return c.AWS.RetryMaxDelay
+}
+
+func (c *Config) GetRetryBudget() time.Duration {
+	return c.AWS.RetryBudget
+}
+
+func (c *Config) GetCompareFacesRate() float64 {
+	return c.AWS.CompareFacesRate
+}
+
+func (c *Config) GetCompareFacesBurst() int {
+	return c.AWS.CompareFacesBurst
+}
+
+func (c *Config) GetDetectFacesRate() float64 {
+	return c.AWS.DetectFacesRate
+}
+
+func (c *Config) GetDetectFacesBurst() int {
+	return c.AWS.DetectFacesBurst
+}
+
+func (c *Config) GetRateLimitWait() time.Duration {
+	return c.AWS.RateLimitWait
+}
+
+func (c *Config) GetReviewFile() string {
+	return c.Review.File
+}
+
+func (c *Config) GetReviewRetention() time.Duration {
+	return c.Review.Retention
+}
+
+func (c *Config) GetDownloadWorkers() int {
+	return c.Workers.Download
+}
+
+func (c *Config) GetDownloadRequestWorkers() int {
+	return c.Workers.DownloadRequest
+}
+
+func (c *Config) GetCompareWorkers() int {
+	return c.Workers.Compare
+}
+
+func (c *Config) GetCompareRequestWorkers() int {
+	return c.Workers.CompareRequest
+}
+
+func (c *Config) GetDownloadConnectTimeout() time.Duration {
+	return c.Downloader.ConnectTimeout
+}
+
+func (c *Config) GetDownloadReadTimeout() time.Duration {
+	return c.Downloader.ReadTimeout
+}
+
+func (c *Config) GetDownloadMaxSize() int64 {
+	return c.Downloader.MaxSize
+}
+
+func (c *Config) GetDownloadMaxRedirects() int {
+	return c.Downloader.MaxRedirects
+}
+
+func (c *Config) GetDownloadAllowedNetworks() []string {
+	return c.Downloader.AllowedNetworks
+}
+
+func (c *Config) GetDownloadAllowedDomains() []string {
+	return c.Downloader.AllowedDomains
+}
+
+func (c *Config) GetDownloadDeniedDomains() []string {
+	return c.Downloader.DeniedDomains
+}
+
+func (c *Config) GetBreakerFailureRate() float64 {
+	return c.Breaker.FailureRate
+}
+
+func (c *Config) GetBreakerWindow() int {
+	return c.Breaker.Window
+}
+
+func (c *Config) GetBreakerMinRequests() int {
+	return c.Breaker.MinRequests
+}
+
+func (c *Config) GetBreakerOpenTimeout() time.Duration {
+	return c.Breaker.OpenTimeout
+}
+
+func (c *Config) GetBreakerHalfOpenRequests() int {
+	return c.Breaker.HalfOpenRequests
+}
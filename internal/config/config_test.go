@@ -1,6 +1,9 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -11,4 +14,69 @@ func TestConfig(t *testing.T) {
 		_, err := New("/very/wrong/path.conf")
 		require.ErrorIs(t, err, ErrConfigRead, "Error must be: %q, actual: %q", ErrConfigRead, err)
 	})
+
+	t.Run("defaults", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		require.NoError(t, os.WriteFile(path, []byte("[http]\nport = \"8080\"\n"), 0o600))
+
+		config, err := New(path)
+		require.NoError(t, err)
+		require.True(t, config.GetAlwaysOK())
+		require.Equal(t, 100, config.GetDownloadWorkers())
+		require.Equal(t, 10, config.GetDownloadRequestWorkers())
+		require.Equal(t, 20, config.GetCompareWorkers())
+		require.Equal(t, 5, config.GetCompareRequestWorkers())
+	})
+
+	t.Run("thresholds", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+
+		tests := map[string]struct {
+			content    string
+			similarity float64
+			borderline float64
+			err        error
+		}{
+			"default":           {content: "[aws]\n", similarity: 80},
+			"fractional":        {content: "[aws]\nsimilarity_threshold = 90.5\nborderline_threshold = 70.25\n", similarity: 90.5, borderline: 70.25},
+			"quoted":            {content: "[aws]\nsimilarity_threshold = \"85.5\"\n", similarity: 85.5},
+			"borderline above":  {content: "[aws]\nsimilarity_threshold = 80\nborderline_threshold = 85\n", err: ErrConfigInvalid},
+			"borderline equal":  {content: "[aws]\nsimilarity_threshold = 80\nborderline_threshold = 80\n", err: ErrConfigInvalid},
+			"negative":          {content: "[aws]\nsimilarity_threshold = 80\nborderline_threshold = -1\n", err: ErrConfigInvalid},
+			"similarity over":   {content: "[aws]\nsimilarity_threshold = 101\n", err: ErrConfigInvalid},
+			"similarity zero":   {content: "[aws]\nsimilarity_threshold = 0\n", err: ErrConfigInvalid},
+			"similarity not ok": {content: "[aws]\nsimilarity_threshold = \"high\"\n", err: ErrConfigInvalid},
+		}
+
+		for name, tt := range tests {
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600), name)
+
+			config, err := New(path)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err, name)
+				continue
+			}
+
+			require.NoError(t, err, name)
+			require.Equal(t, tt.similarity, config.GetSimilarityThreshold(), name)
+			require.Equal(t, tt.borderline, config.GetBorderlineThreshold(), name)
+		}
+	})
+
+	t.Run("review route", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		require.NoError(t, os.WriteFile(path, []byte("[http]\nport = \"8080\"\n"), 0o600))
+
+		config, err := New(path)
+		require.NoError(t, err)
+		require.Equal(t, "/review/", config.GetReviewRouteTpl())
+
+		for _, route := range []string{"", "/"} {
+			content := fmt.Sprintf("[http]\nreview_route_tpl = %q\n", route)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+			_, err := New(path)
+			require.ErrorIs(t, err, ErrConfigInvalid, "route: %q", route)
+		}
+	})
 }
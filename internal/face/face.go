@@ -0,0 +1,121 @@
+package face
+
+// BoundingBox is a face position on an image.
+// All the values are ratios of the overall image width or height.
+type BoundingBox struct {
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Face is a face found on an image.
+type Face struct {
+	BoundingBox BoundingBox `json:"bounding_box"`
+	Confidence  float64     `json:"confidence"`
+}
+
+// Match is a target image face matching the source one.
+type Match struct {
+	Face
+	Similarity float64 `json:"similarity"`
+}
+
+// Comparison is an outcome of comparing the source image face with the target image faces.
+type Comparison struct {
+	SourceFace     Face    `json:"source_face"`
+	Matches        []Match `json:"matches"`
+	UnmatchedFaces []Match `json:"unmatched_faces"`
+
+	// Attempts is the number of calls made to the backend to get the comparison.
+	Attempts int `json:"attempts"`
+}
+
+// Similarity returns the best similarity among all the target faces.
+func (c Comparison) Similarity() float64 {
+	similarity := 0.0
+	for _, match := range append(append([]Match{}, c.Matches...), c.UnmatchedFaces...) {
+		if match.Similarity > similarity {
+			similarity = match.Similarity
+		}
+	}
+
+	return similarity
+}
+
+// WithThreshold returns a copy of the comparison where the faces
+// less similar than the threshold are moved to the unmatched ones.
+func (c Comparison) WithThreshold(threshold float64) Comparison {
+	comparison := Comparison{
+		SourceFace:     c.SourceFace,
+		Attempts:       c.Attempts,
+		Matches:        make([]Match, 0, len(c.Matches)),
+		UnmatchedFaces: make([]Match, 0, len(c.Matches)+len(c.UnmatchedFaces)),
+	}
+
+	for _, match := range c.Matches {
+		if match.Similarity >= threshold {
+			comparison.Matches = append(comparison.Matches, match)
+		} else {
+			comparison.UnmatchedFaces = append(comparison.UnmatchedFaces, match)
+		}
+	}
+
+	comparison.UnmatchedFaces = append(comparison.UnmatchedFaces, c.UnmatchedFaces...)
+
+	return comparison
+}
+
+// Details are the attributes of a face found on an image, the confidences are percentages.
+type Details struct {
+	Face
+	AgeRange   AgeRange  `json:"age_range"`
+	Gender     Gender    `json:"gender"`
+	Emotions   []Emotion `json:"emotions"`
+	Smile      Attribute `json:"smile"`
+	Eyeglasses Attribute `json:"eyeglasses"`
+	Sunglasses Attribute `json:"sunglasses"`
+	Beard      Attribute `json:"beard"`
+	Mustache   Attribute `json:"mustache"`
+	EyesOpen   Attribute `json:"eyes_open"`
+	MouthOpen  Attribute `json:"mouth_open"`
+	Pose       Pose      `json:"pose"`
+	Quality    Quality   `json:"quality"`
+}
+
+// AgeRange is the estimated age of a face in years.
+type AgeRange struct {
+	Low  int `json:"low"`
+	High int `json:"high"`
+}
+
+// Gender is the predicted gender, either "male" or "female".
+type Gender struct {
+	Value      string  `json:"value"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Emotion is an emotion the face appears to express, e.g. "happy".
+type Emotion struct {
+	Type       string  `json:"type"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Attribute tells whether the face has a feature, e.g. a beard.
+type Attribute struct {
+	Value      bool    `json:"value"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Pose is the face rotation in degrees.
+type Pose struct {
+	Roll  float64 `json:"roll"`
+	Yaw   float64 `json:"yaw"`
+	Pitch float64 `json:"pitch"`
+}
+
+// Quality is the face brightness and sharpness, from 0 to 100.
+type Quality struct {
+	Brightness float64 `json:"brightness"`
+	Sharpness  float64 `json:"sharpness"`
+}
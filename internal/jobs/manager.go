@@ -0,0 +1,278 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/spendmail/face_comparison/internal/storage"
+)
+
+type Config interface {
+	GetJobWorkers() int
+	GetJobQueueSize() int
+	GetJobResultTTL() time.Duration
+}
+
+type Application interface {
+	CompareImages(ctx context.Context, reference string, targets []string, options internalApp.Options) internalApp.ComparisonResult
+}
+
+// Notifier is told about the finished jobs having a callback url.
+type Notifier interface {
+	Notify(job Job)
+}
+
+type Status string
+
+const (
+	StatusQueued   Status = "queued"
+	StatusRunning  Status = "running"
+	StatusDone     Status = "done"
+	StatusCanceled Status = "canceled"
+)
+
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job is already finished")
+	ErrNoCallbacks = errors.New("callbacks are not configured")
+)
+
+// Job is a comparison run in the background, Result is set once the job is finished.
+// A canceled job keeps the result of the targets compared before it was canceled, if it was running.
+type Job struct {
+	ID          string
+	Owner       string
+	Status      Status
+	Reference   string
+	Targets     []string
+	Options     internalApp.Options
+	CallbackURL string
+	Result      *internalApp.ComparisonResult
+	CreatedAt   time.Time
+	StartedAt   *time.Time
+	FinishedAt  *time.Time
+}
+
+type job struct {
+	Job
+	cancel context.CancelFunc
+}
+
+// Manager runs the jobs by a fixed number of workers, the jobs waiting for a worker are queued up to the queue size.
+// Finished jobs are kept for the result ttl, the ones having a callback url are passed to the notifier.
+type Manager struct {
+	app      Application
+	notifier Notifier
+	workers  int
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	jobs  map[string]*job
+	queue chan *job
+}
+
+// New creates a manager, callback urls are refused if the notifier is nil.
+func New(config Config, app Application, notifier Notifier) *Manager {
+	workers := config.GetJobWorkers()
+	if workers < 1 {
+		workers = 1
+	}
+
+	queueSize := config.GetJobQueueSize()
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	return &Manager{
+		app:      app,
+		notifier: notifier,
+		workers:  workers,
+		ttl:      config.GetJobResultTTL(),
+		jobs:     make(map[string]*job),
+		queue:    make(chan *job, queueSize),
+	}
+}
+
+// Run works the jobs off until ctx is done, the running jobs are canceled then.
+func (m *Manager) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.work(ctx)
+		}()
+	}
+
+	interval := m.ttl / 2
+	if interval <= 0 || interval > time.Minute {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case now := <-ticker.C:
+			m.sweep(now)
+		}
+	}
+}
+
+// Submit queues a new job, it fails right away if the queue is full.
+// The finished job is posted to the callback url if it is set.
+func (m *Manager) Submit(owner, callbackURL, reference string, targets []string, options internalApp.Options) (Job, error) {
+	if callbackURL != "" && m.notifier == nil {
+		return Job{}, ErrNoCallbacks
+	}
+
+	id, err := storage.NewID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	j := &job{Job: Job{
+		ID:          id,
+		Owner:       owner,
+		Status:      StatusQueued,
+		Reference:   reference,
+		Targets:     targets,
+		Options:     options,
+		CallbackURL: callbackURL,
+		CreatedAt:   time.Now(),
+	}}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case m.queue <- j:
+	default:
+		return Job{}, ErrQueueFull
+	}
+
+	m.jobs[id] = j
+
+	return j.Job, nil
+}
+
+func (m *Manager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+
+	return j.Job, nil
+}
+
+// Cancel cancels a queued or running job, the running one stops its downloads and comparisons.
+func (m *Manager) Cancel(id string) (Job, error) {
+	job, err := m.cancel(id)
+	if err != nil {
+		return job, err
+	}
+
+	// the running jobs are notified by their workers once they stop
+	if job.FinishedAt != nil {
+		m.notify(job)
+	}
+
+	return job, nil
+}
+
+func (m *Manager) cancel(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+
+	switch j.Status {
+	case StatusQueued:
+		now := time.Now()
+		j.Status = StatusCanceled
+		j.FinishedAt = &now
+	case StatusRunning:
+		j.Status = StatusCanceled
+		j.cancel()
+	default:
+		return j.Job, fmt.Errorf("%w: %s", ErrJobFinished, id)
+	}
+
+	return j.Job, nil
+}
+
+func (m *Manager) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-m.queue:
+			m.run(ctx, j)
+		}
+	}
+}
+
+func (m *Manager) run(ctx context.Context, j *job) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.mu.Lock()
+	// the job has been canceled while it was queued
+	if j.Status != StatusQueued {
+		m.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	j.Status = StatusRunning
+	j.StartedAt = &now
+	j.cancel = cancel
+	m.mu.Unlock()
+
+	result := m.app.CompareImages(ctx, j.Reference, j.Targets, j.Options)
+
+	m.mu.Lock()
+	now = time.Now()
+	j.Result = &result
+	j.FinishedAt = &now
+	if j.Status == StatusRunning {
+		j.Status = StatusDone
+	}
+	job := j.Job
+	m.mu.Unlock()
+
+	m.notify(job)
+}
+
+func (m *Manager) notify(job Job) {
+	if job.CallbackURL != "" && m.notifier != nil {
+		m.notifier.Notify(job)
+	}
+}
+
+// sweep forgets the jobs finished more than the result ttl ago.
+func (m *Manager) sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, j := range m.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) >= m.ttl {
+			delete(m.jobs, id)
+		}
+	}
+}
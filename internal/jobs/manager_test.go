@@ -0,0 +1,198 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeConfig struct {
+	workers   int
+	queueSize int
+}
+
+func (c fakeConfig) GetJobWorkers() int           { return c.workers }
+func (c fakeConfig) GetJobQueueSize() int         { return c.queueSize }
+func (fakeConfig) GetJobResultTTL() time.Duration { return time.Hour }
+
+// blockingApplication compares until it is released or its context is canceled.
+type blockingApplication struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingApplication() *blockingApplication {
+	return &blockingApplication{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (a *blockingApplication) CompareImages(ctx context.Context, reference string, targets []string, options internalApp.Options) internalApp.ComparisonResult {
+	a.started <- struct{}{}
+
+	select {
+	case <-a.release:
+	case <-ctx.Done():
+	}
+
+	return internalApp.ComparisonResult{Reference: internalApp.ImageResult{URL: reference}, Gender: "female"}
+}
+
+type chanNotifier chan Job
+
+func (n chanNotifier) Notify(job Job) {
+	n <- job
+}
+
+func runManager(t *testing.T, manager *Manager) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitStatus(t *testing.T, manager *Manager, id string, status Status) Job {
+	t.Helper()
+
+	var job Job
+	require.Eventually(t, func() bool {
+		var err error
+		job, err = manager.Get(id)
+		require.NoError(t, err)
+		return job.Status == status && (status == StatusRunning || job.FinishedAt != nil)
+	}, time.Second, 5*time.Millisecond)
+
+	return job
+}
+
+func TestManager(t *testing.T) {
+	t.Run("done", func(t *testing.T) {
+		app := newBlockingApplication()
+		manager := New(fakeConfig{workers: 1, queueSize: 1}, app, nil)
+		runManager(t, manager)
+
+		job, err := manager.Submit("key/partner", "", "a", []string{"b"}, internalApp.Options{})
+		require.NoError(t, err)
+		require.Equal(t, StatusQueued, job.Status)
+		require.Equal(t, "key/partner", job.Owner)
+
+		<-app.started
+		waitStatus(t, manager, job.ID, StatusRunning)
+		close(app.release)
+
+		job = waitStatus(t, manager, job.ID, StatusDone)
+		require.NotNil(t, job.Result)
+		require.Equal(t, "female", job.Result.Gender)
+		require.NotNil(t, job.StartedAt)
+
+		_, err = manager.Cancel(job.ID)
+		require.ErrorIs(t, err, ErrJobFinished)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		app := newBlockingApplication()
+		manager := New(fakeConfig{workers: 1, queueSize: 1}, app, nil)
+		runManager(t, manager)
+
+		running, err := manager.Submit("owner", "", "a", []string{"b"}, internalApp.Options{})
+		require.NoError(t, err)
+		<-app.started
+
+		queued, err := manager.Submit("owner", "", "a", []string{"b"}, internalApp.Options{})
+		require.NoError(t, err)
+
+		_, err = manager.Submit("owner", "", "a", []string{"b"}, internalApp.Options{})
+		require.ErrorIs(t, err, ErrQueueFull)
+
+		job, err := manager.Cancel(queued.ID)
+		require.NoError(t, err)
+		require.Equal(t, StatusCanceled, job.Status)
+
+		_, err = manager.Cancel(running.ID)
+		require.NoError(t, err)
+
+		job = waitStatus(t, manager, running.ID, StatusCanceled)
+		require.NotNil(t, job.Result)
+
+		// the canceled queued job is skipped by the worker
+		select {
+		case <-app.started:
+			t.Fatal("canceled job was started")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		app := newBlockingApplication()
+		notifier := make(chanNotifier, 10)
+		manager := New(fakeConfig{workers: 1, queueSize: 1}, app, notifier)
+		runManager(t, manager)
+
+		running, err := manager.Submit("owner", "http://callback", "a", []string{"b"}, internalApp.Options{})
+		require.NoError(t, err)
+		<-app.started
+
+		queued, err := manager.Submit("owner", "http://callback", "a", []string{"b"}, internalApp.Options{})
+		require.NoError(t, err)
+
+		_, err = manager.Cancel(queued.ID)
+		require.NoError(t, err)
+
+		job := <-notifier
+		require.Equal(t, queued.ID, job.ID)
+		require.Equal(t, StatusCanceled, job.Status)
+
+		close(app.release)
+
+		job = <-notifier
+		require.Equal(t, running.ID, job.ID)
+		require.Equal(t, StatusDone, job.Status)
+		require.Equal(t, "http://callback", job.CallbackURL)
+		require.NotNil(t, job.Result)
+	})
+
+	t.Run("callbacks disabled", func(t *testing.T) {
+		manager := New(fakeConfig{}, newBlockingApplication(), nil)
+
+		_, err := manager.Submit("owner", "http://callback", "a", []string{"b"}, internalApp.Options{})
+		require.ErrorIs(t, err, ErrNoCallbacks)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		manager := New(fakeConfig{}, newBlockingApplication(), nil)
+
+		_, err := manager.Get("missing")
+		require.ErrorIs(t, err, ErrJobNotFound)
+
+		_, err = manager.Cancel("missing")
+		require.ErrorIs(t, err, ErrJobNotFound)
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		app := newBlockingApplication()
+		close(app.release)
+		manager := New(fakeConfig{workers: 1, queueSize: 1}, app, nil)
+		runManager(t, manager)
+
+		job, err := manager.Submit("owner", "", "a", []string{"b"}, internalApp.Options{})
+		require.NoError(t, err)
+		waitStatus(t, manager, job.ID, StatusDone)
+
+		manager.sweep(time.Now())
+		_, err = manager.Get(job.ID)
+		require.NoError(t, err)
+
+		manager.sweep(time.Now().Add(time.Hour))
+		_, err = manager.Get(job.ID)
+		require.ErrorIs(t, err, ErrJobNotFound)
+	})
+}
@@ -0,0 +1,234 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/storage"
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+type Config interface {
+	GetRequestsRate() float64
+	GetRequestsBurst() int
+	GetImagesPerDay() int
+	GetQuotaFile() string
+	GetQuotaFlushInterval() time.Duration
+}
+
+type Logger interface {
+	Error(args ...interface{})
+}
+
+var (
+	ErrTooManyRequests = errors.New("too many requests")
+	ErrQuotaExceeded   = errors.New("daily images quota exceeded")
+	ErrQuotaRead       = errors.New("unable to read quota file")
+	ErrQuotaWrite      = errors.New("unable to write quota file")
+)
+
+// RetryAfter is the cause of a rejected request, it tells when the client may try again.
+type RetryAfter time.Duration
+
+func (r RetryAfter) Error() string {
+	return fmt.Sprintf("retry after %s", time.Duration(r).Round(time.Second))
+}
+
+// usage is the number of images a client has sent during the day, the day is in UTC.
+type usage struct {
+	Day    string `json:"day"`
+	Images int    `json:"images"`
+}
+
+// Limiter limits the requests per second and the images per day of every client, zero limits mean no limit.
+// The counters are kept in memory, the daily usage is also dumped to the file periodically
+// and on Run exit, so it survives a restart.
+type Limiter struct {
+	logger   Logger
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	perDay   int
+	file     string
+	interval time.Duration
+	buckets  map[string]*bucket
+	usage    map[string]usage
+	dirty    bool
+}
+
+func New(config Config, logger Logger) (*Limiter, error) {
+	l := &Limiter{
+		logger:   logger,
+		rate:     config.GetRequestsRate(),
+		burst:    float64(config.GetRequestsBurst()),
+		perDay:   config.GetImagesPerDay(),
+		file:     config.GetQuotaFile(),
+		interval: config.GetQuotaFlushInterval(),
+		buckets:  make(map[string]*bucket),
+		usage:    make(map[string]usage),
+	}
+
+	if l.burst < 1 {
+		l.burst = math.Max(1, math.Ceil(l.rate))
+	}
+
+	if l.interval <= 0 {
+		l.interval = 10 * time.Second
+	}
+
+	if l.file == "" {
+		return l, nil
+	}
+
+	content, err := os.ReadFile(l.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, wrap.New(ErrQuotaRead, err)
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &l.usage); err != nil {
+			return nil, wrap.New(ErrQuotaRead, err)
+		}
+	}
+
+	return l, nil
+}
+
+// Admit takes a request of the client carrying the number of images,
+// a rejected request doesn't use up the daily quota.
+func (l *Limiter) Admit(client string, images int) error {
+	return l.admit(client, images, time.Now())
+}
+
+func (l *Limiter) admit(client string, images int, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate > 0 {
+		b, ok := l.buckets[client]
+		if !ok {
+			b = &bucket{tokens: l.burst, last: now}
+			l.buckets[client] = b
+		}
+
+		if wait := b.take(l.rate, l.burst, now); wait > 0 {
+			return wrap.New(ErrTooManyRequests, RetryAfter(wait))
+		}
+	}
+
+	if l.perDay <= 0 || images <= 0 {
+		return nil
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	u := l.usage[client]
+	if u.Day != day {
+		u = usage{Day: day}
+	}
+
+	if u.Images+images > l.perDay {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return wrap.New(ErrQuotaExceeded, RetryAfter(tomorrow.Sub(now)))
+	}
+
+	u.Images += images
+	l.usage[client] = u
+	l.dirty = true
+
+	return nil
+}
+
+// Run dumps the usage every flush interval until ctx is done, then dumps it for the last time.
+// Idle clients are forgotten along the way, failed dumps are logged and retried on the next tick.
+func (l *Limiter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return l.Flush()
+		case now := <-ticker.C:
+			l.sweep(now)
+			if err := l.Flush(); err != nil {
+				l.logger.Error(err)
+			}
+		}
+	}
+}
+
+// sweep forgets the buckets which are full again and the usage of the past days.
+func (l *Limiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	for client, u := range l.usage {
+		if u.Day != day {
+			delete(l.usage, client)
+			l.dirty = true
+		}
+	}
+}
+
+// Flush writes the usage to a temporary file and moves it over the quota file, if anything has changed.
+func (l *Limiter) Flush() error {
+	l.mu.Lock()
+	if l.file == "" || !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+
+	content, err := json.Marshal(l.usage)
+	l.dirty = false
+	l.mu.Unlock()
+
+	if err != nil {
+		return wrap.New(ErrQuotaWrite, err)
+	}
+
+	if err := storage.WriteFile(l.file, content); err != nil {
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+
+		return wrap.New(ErrQuotaWrite, err)
+	}
+
+	return nil
+}
+
+// bucket allows rate requests per second on average and up to burst requests at once.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take returns zero if the request is allowed, otherwise the time until it would be.
+func (b *bucket) take(rate, burst float64, now time.Time) time.Duration {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+
+	b.tokens--
+
+	return 0
+}
@@ -0,0 +1,92 @@
+package quota
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Error(args ...interface{}) {}
+
+type fakeConfig struct {
+	rate   float64
+	burst  int
+	perDay int
+	file   string
+}
+
+func (c fakeConfig) GetRequestsRate() float64             { return c.rate }
+func (c fakeConfig) GetRequestsBurst() int                { return c.burst }
+func (c fakeConfig) GetImagesPerDay() int                 { return c.perDay }
+func (c fakeConfig) GetQuotaFile() string                 { return c.file }
+func (c fakeConfig) GetQuotaFlushInterval() time.Duration { return 10 * time.Millisecond }
+
+func TestLimiterRate(t *testing.T) {
+	limiter, err := New(fakeConfig{rate: 2, burst: 2}, nopLogger{})
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, limiter.admit("a", 0, now))
+	require.NoError(t, limiter.admit("a", 0, now))
+
+	err = limiter.admit("a", 0, now)
+	require.ErrorIs(t, err, ErrTooManyRequests)
+
+	var retryAfter RetryAfter
+	require.ErrorAs(t, err, &retryAfter)
+	require.Equal(t, RetryAfter(500*time.Millisecond), retryAfter)
+
+	require.NoError(t, limiter.admit("b", 0, now))
+	require.NoError(t, limiter.admit("a", 0, now.Add(500*time.Millisecond)))
+
+	// full buckets are forgotten
+	limiter.sweep(now.Add(time.Hour))
+	require.Empty(t, limiter.buckets)
+}
+
+func TestLimiterImagesPerDay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quota.json")
+	config := fakeConfig{perDay: 10, file: file}
+
+	limiter, err := New(config, nopLogger{})
+	require.NoError(t, err)
+
+	day := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	require.NoError(t, limiter.admit("a", 6, day))
+
+	err = limiter.admit("a", 6, day)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	var retryAfter RetryAfter
+	require.ErrorAs(t, err, &retryAfter)
+	require.Equal(t, RetryAfter(4*time.Hour), retryAfter)
+
+	// the usage survives a restart
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, limiter.Run(ctx))
+
+	limiter, err = New(config, nopLogger{})
+	require.NoError(t, err)
+	require.NoError(t, limiter.admit("a", 4, day))
+	require.ErrorIs(t, limiter.admit("a", 1, day), ErrQuotaExceeded)
+
+	// and starts over the next day
+	require.NoError(t, limiter.admit("a", 10, day.Add(4*time.Hour)))
+}
+
+func TestLimiterFlushError(t *testing.T) {
+	limiter, err := New(fakeConfig{perDay: 10, file: filepath.Join(t.TempDir(), "missing", "quota.json")}, nopLogger{})
+	require.NoError(t, err)
+	require.NoError(t, limiter.admit("a", 1, time.Now()))
+
+	err = limiter.Flush()
+	require.ErrorIs(t, err, ErrQuotaWrite)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
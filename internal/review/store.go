@@ -0,0 +1,275 @@
+package review
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spendmail/face_comparison/internal/storage"
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+type Config interface {
+	GetReviewFile() string
+	GetReviewRetention() time.Duration
+}
+
+// Verdict is a human decision on a borderline comparison.
+type Verdict string
+
+const (
+	VerdictPending   Verdict = ""
+	VerdictSame      Verdict = "same"
+	VerdictDifferent Verdict = "different"
+)
+
+// Item is a borderline comparison waiting for or having a verdict.
+type Item struct {
+	ID         string     `json:"id"`
+	Reference  string     `json:"reference"`
+	Target     string     `json:"target"`
+	Similarity float64    `json:"similarity"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Verdict    Verdict    `json:"verdict"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+}
+
+// Store keeps the review items in memory and dumps them to a file on every change.
+// Without a file configured the items are kept in memory only.
+// Reviewed items are dropped after the retention period, zero retention keeps them forever.
+type Store struct {
+	mu        sync.Mutex
+	file      string
+	retention time.Duration
+	items     []*Item
+	version   int
+
+	// the file is written outside of mu, so the readers don't wait for the disk
+	writeMu sync.Mutex
+	written int
+}
+
+var (
+	ErrStoreRead     = errors.New("unable to read review store file")
+	ErrStoreWrite    = errors.New("unable to write review store file")
+	ErrItemNotFound  = errors.New("review item not found")
+	ErrWrongVerdict  = errors.New("wrong verdict")
+	ErrAlreadyJudged = errors.New("review item already has a verdict")
+)
+
+func New(config Config) (*Store, error) {
+	s := &Store{
+		file:      config.GetReviewFile(),
+		retention: config.GetReviewRetention(),
+		items:     make([]*Item, 0),
+	}
+
+	if s.file == "" {
+		return s, nil
+	}
+
+	content, err := os.ReadFile(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, wrap.New(ErrStoreRead, err)
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &s.items); err != nil {
+			return nil, wrap.New(ErrStoreRead, err)
+		}
+		s.prune(time.Now().UTC())
+	}
+
+	return s, nil
+}
+
+// Add puts a new pending item to the store.
+func (s *Store) Add(reference, target string, similarity float64) (Item, error) {
+	id, err := storage.NewID()
+	if err != nil {
+		return Item{}, err
+	}
+
+	item := &Item{
+		ID:         id,
+		Reference:  reference,
+		Target:     target,
+		Similarity: similarity,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	s.prune(item.CreatedAt)
+	s.items = append(s.items, item)
+	content, version, err := s.snapshot()
+	s.mu.Unlock()
+
+	if err == nil {
+		err = s.flush(content, version)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.remove(item.ID)
+		s.mu.Unlock()
+		return Item{}, err
+	}
+
+	return *item, nil
+}
+
+// Get returns an item by its id.
+func (s *Store) Get(id string) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := s.find(id)
+	if item == nil {
+		return Item{}, fmt.Errorf("%w: %s", ErrItemNotFound, id)
+	}
+
+	return *item, nil
+}
+
+// Pending returns items without a verdict, the oldest ones go first.
+func (s *Store) Pending() []Item {
+	return s.filter(func(item *Item) bool {
+		return item.Verdict == VerdictPending
+	})
+}
+
+// Reviewed returns items having a verdict, it's used for the threshold recalibration.
+func (s *Store) Reviewed() []Item {
+	return s.filter(func(item *Item) bool {
+		return item.Verdict != VerdictPending
+	})
+}
+
+// SetVerdict records a human decision for the pending item.
+func (s *Store) SetVerdict(id string, verdict Verdict) (Item, error) {
+	if verdict != VerdictSame && verdict != VerdictDifferent {
+		return Item{}, fmt.Errorf("%w: %q", ErrWrongVerdict, verdict)
+	}
+
+	s.mu.Lock()
+	item := s.find(id)
+	if item == nil {
+		s.mu.Unlock()
+		return Item{}, fmt.Errorf("%w: %s", ErrItemNotFound, id)
+	}
+
+	if item.Verdict != VerdictPending {
+		s.mu.Unlock()
+		return Item{}, fmt.Errorf("%w: %s", ErrAlreadyJudged, id)
+	}
+
+	now := time.Now().UTC()
+	item.Verdict = verdict
+	item.ReviewedAt = &now
+	judged := *item
+	content, version, err := s.snapshot()
+	s.mu.Unlock()
+
+	if err == nil {
+		err = s.flush(content, version)
+	}
+	if err != nil {
+		s.mu.Lock()
+		item.Verdict = VerdictPending
+		item.ReviewedAt = nil
+		s.mu.Unlock()
+		return Item{}, err
+	}
+
+	return judged, nil
+}
+
+func (s *Store) find(id string) *Item {
+	for _, item := range s.items {
+		if item.ID == id {
+			return item
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) remove(id string) {
+	for i, item := range s.items {
+		if item.ID == id {
+			s.items = append(s.items[:i], s.items[i+1:]...)
+			return
+		}
+	}
+}
+
+// prune drops the items reviewed before the retention period.
+func (s *Store) prune(now time.Time) {
+	if s.retention <= 0 {
+		return
+	}
+
+	items := s.items[:0]
+	for _, item := range s.items {
+		if item.ReviewedAt == nil || now.Sub(*item.ReviewedAt) < s.retention {
+			items = append(items, item)
+		}
+	}
+	s.items = items
+}
+
+func (s *Store) filter(fn func(item *Item) bool) []Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]Item, 0, len(s.items))
+	for _, item := range s.items {
+		if fn(item) {
+			items = append(items, *item)
+		}
+	}
+
+	return items
+}
+
+// snapshot marshals the items to be written to the store file, it must be called under mu.
+func (s *Store) snapshot() ([]byte, int, error) {
+	if s.file == "" {
+		return nil, 0, nil
+	}
+
+	content, err := json.Marshal(s.items)
+	if err != nil {
+		return nil, 0, wrap.New(ErrStoreWrite, err)
+	}
+
+	s.version++
+
+	return content, s.version, nil
+}
+
+// flush writes the snapshot to the store file unless a later one has been written already.
+func (s *Store) flush(content []byte, version int) error {
+	if s.file == "" {
+		return nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if version <= s.written {
+		return nil
+	}
+
+	if err := storage.WriteFile(s.file, content); err != nil {
+		return wrap.New(ErrStoreWrite, err)
+	}
+	s.written = version
+
+	return nil
+}
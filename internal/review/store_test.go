@@ -0,0 +1,134 @@
+package review
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fileConfig struct {
+	file      string
+	retention time.Duration
+}
+
+func (c fileConfig) GetReviewFile() string {
+	return c.file
+}
+
+func (c fileConfig) GetReviewRetention() time.Duration {
+	return c.retention
+}
+
+func TestStore(t *testing.T) {
+	t.Run("verdicts survive a restart", func(t *testing.T) {
+		config := fileConfig{file: filepath.Join(t.TempDir(), "review.json")}
+
+		store, err := New(config)
+		require.NoError(t, err)
+
+		first, err := store.Add("http://example.com/a.jpg", "http://example.com/b.jpg", 81.5)
+		require.NoError(t, err)
+		second, err := store.Add("http://example.com/a.jpg", "http://example.com/c.jpg", 75)
+		require.NoError(t, err)
+
+		_, err = store.SetVerdict(first.ID, VerdictSame)
+		require.NoError(t, err)
+
+		store, err = New(config)
+		require.NoError(t, err)
+
+		pending := store.Pending()
+		require.Len(t, pending, 1)
+		require.Equal(t, second.ID, pending[0].ID)
+
+		reviewed := store.Reviewed()
+		require.Len(t, reviewed, 1)
+		require.Equal(t, VerdictSame, reviewed[0].Verdict)
+		require.Equal(t, 81.5, reviewed[0].Similarity)
+		require.NotNil(t, reviewed[0].ReviewedAt)
+	})
+
+	t.Run("wrong verdicts", func(t *testing.T) {
+		store, err := New(fileConfig{})
+		require.NoError(t, err)
+
+		item, err := store.Add("http://example.com/a.jpg", "http://example.com/b.jpg", 80)
+		require.NoError(t, err)
+
+		_, err = store.SetVerdict(item.ID, "maybe")
+		require.ErrorIs(t, err, ErrWrongVerdict)
+
+		_, err = store.SetVerdict("unknown", VerdictSame)
+		require.ErrorIs(t, err, ErrItemNotFound)
+
+		_, err = store.SetVerdict(item.ID, VerdictDifferent)
+		require.NoError(t, err)
+
+		_, err = store.SetVerdict(item.ID, VerdictSame)
+		require.ErrorIs(t, err, ErrAlreadyJudged)
+	})
+
+	t.Run("reviewed items are dropped after the retention", func(t *testing.T) {
+		config := fileConfig{file: filepath.Join(t.TempDir(), "review.json"), retention: time.Hour}
+
+		store, err := New(config)
+		require.NoError(t, err)
+
+		old, err := store.Add("http://example.com/a.jpg", "http://example.com/b.jpg", 80)
+		require.NoError(t, err)
+		_, err = store.SetVerdict(old.ID, VerdictSame)
+		require.NoError(t, err)
+		reviewedAt := time.Now().UTC().Add(-2 * time.Hour)
+		store.items[0].ReviewedAt = &reviewedAt
+
+		fresh, err := store.Add("http://example.com/a.jpg", "http://example.com/c.jpg", 80)
+		require.NoError(t, err)
+		_, err = store.SetVerdict(fresh.ID, VerdictDifferent)
+		require.NoError(t, err)
+		pending, err := store.Add("http://example.com/a.jpg", "http://example.com/d.jpg", 80)
+		require.NoError(t, err)
+
+		store, err = New(config)
+		require.NoError(t, err)
+
+		reviewed := store.Reviewed()
+		require.Len(t, reviewed, 1)
+		require.Equal(t, fresh.ID, reviewed[0].ID)
+		require.Len(t, store.Pending(), 1)
+		require.Equal(t, pending.ID, store.Pending()[0].ID)
+	})
+
+	t.Run("concurrent changes", func(t *testing.T) {
+		config := fileConfig{file: filepath.Join(t.TempDir(), "review.json")}
+
+		store, err := New(config)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				item, err := store.Add("http://example.com/a.jpg", fmt.Sprintf("http://example.com/%d.jpg", i), 80)
+				require.NoError(t, err)
+				_, err = store.Get(item.ID)
+				require.NoError(t, err)
+				_, err = store.SetVerdict(item.ID, VerdictSame)
+				require.NoError(t, err)
+				store.Pending()
+			}()
+		}
+		wg.Wait()
+
+		store, err = New(config)
+		require.NoError(t, err)
+		require.Empty(t, store.Pending())
+		require.Len(t, store.Reviewed(), 20)
+	})
+}
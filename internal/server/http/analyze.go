@@ -0,0 +1,56 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/spendmail/face_comparison/internal/auth"
+	"github.com/spendmail/face_comparison/internal/face"
+)
+
+type AnalyzeRequest struct {
+	URL string `json:"url"`
+}
+
+// AnalyzeResponse holds every face found on the image, it is empty if there are none.
+type AnalyzeResponse struct {
+	URL   string         `json:"url"`
+	Faces []face.Details `json:"faces"`
+}
+
+// analyzeHandler returns the attributes of the faces found on a single image.
+func (h *Handler) analyzeHandler(w http.ResponseWriter, r *http.Request) {
+	client, e := h.authorize(r, auth.FeatureAnalyze)
+	if e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	var ar AnalyzeRequest
+	if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+		SendError(w, h, ErrorResponse{
+			Code:    CodeInvalidRequest,
+			Message: fmt.Sprintf("unable to decode the request: %s", err.Error()),
+		})
+		return
+	}
+
+	if ar.URL == "" {
+		SendError(w, h, ErrorResponse{Code: CodeInvalidRequest, Message: "an image url is required"})
+		return
+	}
+
+	if e := h.admit(r, client, 1); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	result := h.App.AnalyzeImage(r.Context(), ar.URL)
+	if result.Err != nil {
+		SendError(w, h, ErrorResponse{Code: result.Code, Message: result.Err.Error(), URL: result.URL})
+		return
+	}
+
+	sendJSON(w, h, http.StatusOK, AnalyzeResponse{URL: result.URL, Faces: result.Faces})
+}
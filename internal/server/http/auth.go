@@ -0,0 +1,99 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/spendmail/face_comparison/internal/auth"
+	"github.com/spendmail/face_comparison/internal/quota"
+)
+
+// authenticate identifies the caller, missing credentials are told apart from wrong ones.
+func (h *Handler) authenticate(r *http.Request) (auth.Client, *ErrorResponse) {
+	client, err := h.Auth.Authenticate(r)
+	if err != nil {
+		code := CodeForbidden
+		switch {
+		case errors.Is(err, auth.ErrNoCredentials):
+			code = CodeUnauthorized
+		case errors.Is(err, auth.ErrTooManyNonces):
+			code = CodeTooManyRequests
+		}
+
+		return client, &ErrorResponse{Code: code, Message: err.Error()}
+	}
+
+	if client.Method == auth.MethodQuerySecret {
+		h.Logger.Warn("the secret query parameter is deprecated, send an api key in the X-API-Key header instead")
+	}
+
+	return client, nil
+}
+
+// authorize authenticates the caller and checks it may use the feature.
+func (h *Handler) authorize(r *http.Request, feature string) (auth.Client, *ErrorResponse) {
+	client, e := h.authenticate(r)
+	if e != nil {
+		return client, e
+	}
+
+	if !client.Allows(feature) {
+		return client, &ErrorResponse{Code: CodeForbidden, Message: fmt.Sprintf("%s feature isn't allowed", feature)}
+	}
+
+	return client, nil
+}
+
+// comparisonOptions skips the parts of a comparison the caller isn't allowed to use.
+func comparisonOptions(client auth.Client) internalApp.Options {
+	return internalApp.Options{SkipGender: !client.Allows(auth.FeatureGender)}
+}
+
+// Clients are limited by their api key or token, or by their ip address.
+const (
+	LimitByKey = "key"
+	LimitByIP  = "ip"
+)
+
+// admit checks the request against the client rate limit and images quota.
+func (h *Handler) admit(r *http.Request, client auth.Client, images int) *ErrorResponse {
+	err := h.Limiter.Admit(limitKey(h.Config.GetLimitBy(), r, client), images)
+	if err == nil {
+		return nil
+	}
+
+	e := &ErrorResponse{Code: internalApp.CodeInternalError, Message: err.Error()}
+
+	var retryAfter quota.RetryAfter
+	if errors.As(err, &retryAfter) {
+		e.Code = CodeTooManyRequests
+		if errors.Is(err, quota.ErrQuotaExceeded) {
+			e.Code = CodeQuotaExceeded
+		}
+		e.retryAfter = time.Duration(retryAfter)
+	}
+
+	return e
+}
+
+// limitKey identifies the client to be limited, all the tokens of a tenant share its limits.
+func limitKey(by string, r *http.Request, client auth.Client) string {
+	if by == LimitByIP {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		return "ip/" + host
+	}
+
+	if client.Tenant != "" {
+		return "tenant/" + client.Tenant
+	}
+
+	return "key/" + client.Name
+}
@@ -0,0 +1,148 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/spendmail/face_comparison/internal/auth"
+)
+
+// BatchSet is a single comparison of a batch request, its id keys the result.
+type BatchSet struct {
+	ID        string   `json:"id"`
+	Reference string   `json:"reference"`
+	URLs      []string `json:"urls"`
+}
+
+// BatchResult is an outcome of a single set, Error is set if the set was rejected or its comparison failed.
+// Result is kept for the failed comparisons as well, as the jobs do.
+type BatchResult struct {
+	Result *ComparisonResponseV2 `json:"result,omitempty"`
+	Error  *ErrorResponse        `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results map[string]BatchResult `json:"results"`
+}
+
+// batchHandler compares the sets independently, up to the batch workers at once, on the limits shared with the other requests.
+// The request is authorized and admitted once for all the sets, a failure of a set doesn't affect the others.
+func (h *Handler) batchHandler(w http.ResponseWriter, r *http.Request) {
+	sets, client, e := h.decodeBatchRequest(r)
+	if e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	rsp := BatchResponse{Results: make(map[string]BatchResult, len(sets))}
+	mu := sync.Mutex{}
+
+	size := h.Config.GetBatchWorkers()
+	if size < 1 {
+		size = 1
+	}
+
+	workers := make(chan struct{}, size)
+	wg := sync.WaitGroup{}
+
+	for _, set := range sets {
+		workers <- struct{}{}
+
+		wg.Add(1)
+		go func(set BatchSet) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			result := h.compareSet(r, client, set)
+
+			mu.Lock()
+			rsp.Results[set.ID] = result
+			mu.Unlock()
+		}(set)
+	}
+
+	wg.Wait()
+
+	sendJSON(w, h, http.StatusOK, rsp)
+}
+
+func (h *Handler) compareSet(r *http.Request, client auth.Client, set BatchSet) BatchResult {
+	if e := checkSet(client, set); e != nil {
+		return BatchResult{Error: e}
+	}
+
+	reference, targets := ComparisonRequest{Reference: set.Reference, URLs: set.URLs}.split()
+	result := h.App.CompareImages(r.Context(), reference, targets, comparisonOptions(client))
+
+	rsp := newComparisonResponseV2(result)
+	for _, e := range rsp.Errors {
+		h.Logger.Error(fmt.Sprintf("set %s: %s", set.ID, e.Message))
+	}
+
+	batchResult := BatchResult{Result: &rsp}
+	if failure, ok := comparisonFailure(result); ok {
+		batchResult.Error = &failure
+	}
+
+	return batchResult
+}
+
+// checkSet validates the set and checks it against the caller url limit.
+func checkSet(client auth.Client, set BatchSet) *ErrorResponse {
+	cr := ComparisonRequest{Reference: set.Reference, URLs: set.URLs}
+
+	reference, targets := cr.split()
+	if e := validateComparisonRequest(reference, targets); e != nil {
+		return e
+	}
+
+	return checkURLLimit(client, cr)
+}
+
+// decodeBatchRequest authorizes the caller and checks the sets, the whole batch is rejected only if the sets can't be told apart.
+// The images of all the valid sets are admitted at once, the invalid ones are rejected by compareSet at no cost.
+func (h *Handler) decodeBatchRequest(r *http.Request) ([]BatchSet, auth.Client, *ErrorResponse) {
+	var sets []BatchSet
+
+	client, e := h.authorize(r, auth.FeatureCompare)
+	if e != nil {
+		return nil, client, e
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&sets); err != nil {
+		return nil, client, &ErrorResponse{
+			Code:    CodeInvalidRequest,
+			Message: fmt.Sprintf("unable to decode the request: %s", err.Error()),
+		}
+	}
+
+	if len(sets) == 0 {
+		return nil, client, &ErrorResponse{Code: CodeInvalidRequest, Message: "at least one set is required"}
+	}
+
+	if maxSets := h.Config.GetBatchMaxSets(); maxSets > 0 && len(sets) > maxSets {
+		return nil, client, &ErrorResponse{Code: CodeInvalidRequest, Message: fmt.Sprintf("%d sets are allowed at most", maxSets)}
+	}
+
+	images := 0
+	ids := make(map[string]struct{}, len(sets))
+	for _, set := range sets {
+		if set.ID == "" {
+			return nil, client, &ErrorResponse{Code: CodeInvalidRequest, Message: "every set requires an id"}
+		}
+
+		if _, ok := ids[set.ID]; ok {
+			return nil, client, &ErrorResponse{Code: CodeInvalidRequest, Message: fmt.Sprintf("duplicate set id %s", set.ID)}
+		}
+		ids[set.ID] = struct{}{}
+
+		if e := checkSet(client, set); e == nil {
+			_, targets := ComparisonRequest{Reference: set.Reference, URLs: set.URLs}.split()
+			images += len(targets) + 1
+		}
+	}
+
+	return sets, client, h.admit(r, client, images)
+}
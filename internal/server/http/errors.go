@@ -0,0 +1,129 @@
+package http
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+)
+
+// Codes of the request level errors, the rest of them come from the application.
+const (
+	CodeInvalidRequest  = "invalid_request"
+	CodeUnauthorized    = "unauthorized"
+	CodeForbidden       = "forbidden"
+	CodeNotFound        = "not_found"
+	CodeConflict        = "conflict"
+	CodeTooManyURLs     = "too_many_urls"
+	CodeTooManyRequests = "too_many_requests"
+	CodeQuotaExceeded   = "quota_exceeded"
+	CodeQueueFull       = "queue_full"
+)
+
+// ErrorResponse is the body of every failed request.
+// URL points to the image which made the request fail, if there is one.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+
+	// retryAfter is sent in the Retry-After header
+	retryAfter time.Duration
+}
+
+// httpStatus maps an error code to the response status.
+func httpStatus(code string) int {
+	switch code {
+	case CodeInvalidRequest:
+		return http.StatusBadRequest
+	case CodeUnauthorized:
+		return http.StatusUnauthorized
+	case CodeForbidden, CodeTooManyURLs:
+		return http.StatusForbidden
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeConflict:
+		return http.StatusConflict
+	case internalApp.CodeNotEnoughImages:
+		return http.StatusUnprocessableEntity
+	// the single image of the request isn't usable
+	case internalApp.CodeInvalidURL, internalApp.CodeHostNotFound, internalApp.CodeDownloadFailed, internalApp.CodeReadFailed,
+		internalApp.CodeUnsupportedType, internalApp.CodeHTTPStatus, internalApp.CodeTooLarge, internalApp.CodeTimeout,
+		internalApp.CodeTooManyRedirects, internalApp.CodeBlocked, internalApp.CodeImageTooLarge, internalApp.CodeInvalidImage,
+		internalApp.CodeInvalidParameter:
+		return http.StatusUnprocessableEntity
+	case internalApp.CodeRateLimited, CodeTooManyRequests, CodeQuotaExceeded:
+		return http.StatusTooManyRequests
+	case internalApp.CodeBreakerOpen, CodeQueueFull:
+		return http.StatusServiceUnavailable
+	case internalApp.CodeBackendError, internalApp.CodeAccessDenied:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// comparisonFailure returns the error which made the whole comparison fail, if there is one.
+// The comparison fails if there are not enough images, or none of the targets could be compared.
+// Failures of single targets are reported in the comparison response instead.
+func comparisonFailure(result internalApp.ComparisonResult) (ErrorResponse, bool) {
+	for _, err := range result.Errors {
+		if internalApp.ErrorCode(err) != internalApp.CodeNotEnoughImages {
+			continue
+		}
+
+		if result.Reference.Err != nil {
+			return ErrorResponse{
+				Code:    internalApp.CodeNotEnoughImages,
+				Message: result.Reference.Err.Error(),
+				URL:     result.Reference.URL,
+			}, true
+		}
+
+		return ErrorResponse{Code: internalApp.CodeNotEnoughImages, Message: err.Error()}, true
+	}
+
+	var failed *internalApp.ImageResult
+	for i, target := range result.Targets {
+		if target.Err == nil {
+			return ErrorResponse{}, false
+		}
+
+		if failed == nil && target.Code != internalApp.CodeCanceled {
+			failed = &result.Targets[i]
+		}
+	}
+
+	if failed == nil {
+		return ErrorResponse{}, false
+	}
+
+	code := failed.Code
+	switch httpStatus(code) {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+	default:
+		// the backend is fine, but the images aren't usable
+		code = internalApp.CodeNotEnoughImages
+	}
+
+	return ErrorResponse{Code: code, Message: failed.Err.Error(), URL: failed.URL}, true
+}
+
+// SendError writes the error with the status matching its code.
+func SendError(w http.ResponseWriter, h *Handler, rsp ErrorResponse) {
+	h.Logger.Error(rsp.Message)
+	setRetryAfter(w, rsp)
+	sendJSON(w, h, httpStatus(rsp.Code), rsp)
+}
+
+// setRetryAfter tells the client when to retry in whole seconds, rounded up.
+func setRetryAfter(w http.ResponseWriter, rsp ErrorResponse) {
+	if rsp.retryAfter <= 0 {
+		return
+	}
+
+	seconds := int64(math.Ceil(rsp.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
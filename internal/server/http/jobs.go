@@ -0,0 +1,207 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/spendmail/face_comparison/internal/auth"
+	"github.com/spendmail/face_comparison/internal/jobs"
+)
+
+type JobManager interface {
+	Submit(owner, callbackURL, reference string, targets []string, options internalApp.Options) (jobs.Job, error)
+	Get(id string) (jobs.Job, error)
+	Cancel(id string) (jobs.Job, error)
+}
+
+// JobResponse is a job status, the result follows the v2 comparison response once the job is finished.
+// Error is set if the whole comparison failed, as the v2 api would have answered.
+type JobResponse struct {
+	ID         string                `json:"id"`
+	Status     jobs.Status           `json:"status"`
+	CreatedAt  time.Time             `json:"created_at"`
+	StartedAt  *time.Time            `json:"started_at,omitempty"`
+	FinishedAt *time.Time            `json:"finished_at,omitempty"`
+	Result     *ComparisonResponseV2 `json:"result,omitempty"`
+	Error      *ErrorResponse        `json:"error,omitempty"`
+}
+
+func newJobResponse(job jobs.Job) JobResponse {
+	rsp := JobResponse{
+		ID:         job.ID,
+		Status:     job.Status,
+		CreatedAt:  job.CreatedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+
+	if job.Result != nil {
+		result := newComparisonResponseV2(*job.Result)
+		rsp.Result = &result
+
+		if failure, ok := comparisonFailure(*job.Result); ok {
+			rsp.Error = &failure
+		}
+	}
+
+	return rsp
+}
+
+// jobSubmitHandler takes the same request as the comparison routes and answers with the queued job.
+func (h *Handler) jobSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	cr, client, e := h.decodeComparisonRequest(r)
+	if e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	reference, targets := cr.split()
+	if e := validateComparisonRequest(reference, targets); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	if e := h.validateCallbackURL(cr.CallbackURL); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	if e := h.admit(r, client, len(targets)+1); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	job, err := h.Jobs.Submit(jobOwner(client), cr.CallbackURL, reference, targets, comparisonOptions(client))
+	if err != nil {
+		SendError(w, h, ErrorResponse{Code: jobErrorCode(err), Message: err.Error()})
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(h.Config.GetJobsRouteTpl(), "/")+"/"+job.ID)
+	sendJSON(w, h, http.StatusAccepted, newJobResponse(job))
+}
+
+func (h *Handler) jobGetHandler(w http.ResponseWriter, r *http.Request) {
+	job, e := h.ownJob(r)
+	if e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	sendJSON(w, h, http.StatusOK, newJobResponse(job))
+}
+
+func (h *Handler) jobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	job, e := h.ownJob(r)
+	if e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	job, err := h.Jobs.Cancel(job.ID)
+	if err != nil {
+		SendError(w, h, ErrorResponse{Code: jobErrorCode(err), Message: err.Error()})
+		return
+	}
+
+	sendJSON(w, h, http.StatusOK, newJobResponse(job))
+}
+
+// ownJob returns the requested job if it belongs to the caller, the jobs of others are reported as missing.
+func (h *Handler) ownJob(r *http.Request) (jobs.Job, *ErrorResponse) {
+	client, e := h.authorize(r, auth.FeatureCompare)
+	if e != nil {
+		return jobs.Job{}, e
+	}
+
+	id := mux.Vars(r)["id"]
+
+	job, err := h.Jobs.Get(id)
+	if err == nil && job.Owner != jobOwner(client) {
+		err = jobs.ErrJobNotFound
+	}
+	if err != nil {
+		return jobs.Job{}, &ErrorResponse{Code: jobErrorCode(err), Message: err.Error()}
+	}
+
+	return job, nil
+}
+
+// validateCallbackURL accepts an empty url or an absolute http one the guard lets through.
+// Internal addresses are refused right away if they're given literally, the host names are checked once resolved on delivery.
+func (h *Handler) validateCallbackURL(callbackURL string) *ErrorResponse {
+	if callbackURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &ErrorResponse{Code: CodeInvalidRequest, Message: "callback url must be an absolute http url", URL: callbackURL}
+	}
+
+	err = h.Guard.CheckURL(u)
+	if ip := net.ParseIP(u.Hostname()); err == nil && ip != nil {
+		err = h.Guard.CheckIP(ip)
+	}
+
+	if err != nil {
+		return &ErrorResponse{Code: internalApp.CodeBlocked, Message: err.Error(), URL: callbackURL}
+	}
+
+	return nil
+}
+
+// jobOwner identifies the caller the same way regardless of the limits configured.
+func jobOwner(client auth.Client) string {
+	return limitKey(LimitByKey, nil, client)
+}
+
+func jobErrorCode(err error) string {
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		return CodeNotFound
+	case errors.Is(err, jobs.ErrJobFinished):
+		return CodeConflict
+	case errors.Is(err, jobs.ErrQueueFull):
+		return CodeQueueFull
+	case errors.Is(err, jobs.ErrNoCallbacks):
+		return CodeInvalidRequest
+	default:
+		return internalApp.CodeInternalError
+	}
+}
+
+// Outbox delivers the signed payloads to the callback urls.
+type Outbox interface {
+	Enqueue(url string, payload []byte) error
+}
+
+// JobNotifier posts the finished jobs to their callback urls, the payload is the job response.
+type JobNotifier struct {
+	Outbox Outbox
+	Logger Logger
+}
+
+func NewJobNotifier(outbox Outbox, logger Logger) *JobNotifier {
+	return &JobNotifier{Outbox: outbox, Logger: logger}
+}
+
+func (n *JobNotifier) Notify(job jobs.Job) {
+	payload, err := json.Marshal(newJobResponse(job))
+	if err != nil {
+		n.Logger.Error(err)
+		return
+	}
+
+	if err := n.Outbox.Enqueue(job.CallbackURL, payload); err != nil {
+		n.Logger.Error(fmt.Errorf("unable to queue the callback of job %s: %w", job.ID, err))
+	}
+}
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/spendmail/face_comparison/internal/auth"
+	"github.com/spendmail/face_comparison/internal/review"
+)
+
+type ReviewStore interface {
+	Get(id string) (review.Item, error)
+	Pending() []review.Item
+	Reviewed() []review.Item
+	SetVerdict(id string, verdict review.Verdict) (review.Item, error)
+}
+
+type VerdictRequest struct {
+	Verdict review.Verdict `json:"verdict"`
+}
+
+type ReviewResponse struct {
+	Items []review.Item `json:"items"`
+}
+
+func (h *Handler) reviewListHandler(w http.ResponseWriter, r *http.Request) {
+	if _, e := h.authorize(r, auth.FeatureReview); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	SendReviewResponse(w, h, http.StatusOK, h.ReviewStore.Pending())
+}
+
+func (h *Handler) reviewItemHandler(w http.ResponseWriter, r *http.Request) {
+	if _, e := h.authorize(r, auth.FeatureReview); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	item, err := h.ReviewStore.Get(mux.Vars(r)["id"])
+	if err != nil {
+		SendError(w, h, ErrorResponse{Code: reviewErrorCode(err), Message: err.Error()})
+		return
+	}
+
+	SendReviewResponse(w, h, http.StatusOK, []review.Item{item})
+}
+
+func (h *Handler) reviewVerdictHandler(w http.ResponseWriter, r *http.Request) {
+	if _, e := h.authorize(r, auth.FeatureReview); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	var vr VerdictRequest
+	if err := json.NewDecoder(r.Body).Decode(&vr); err != nil {
+		SendError(w, h, ErrorResponse{
+			Code:    CodeInvalidRequest,
+			Message: fmt.Sprintf("unable to decode the request: %s", err),
+		})
+		return
+	}
+
+	item, err := h.ReviewStore.SetVerdict(mux.Vars(r)["id"], vr.Verdict)
+	if err != nil {
+		SendError(w, h, ErrorResponse{Code: reviewErrorCode(err), Message: err.Error()})
+		return
+	}
+
+	SendReviewResponse(w, h, http.StatusOK, []review.Item{item})
+}
+
+// reviewExportHandler returns all the judged items, as a csv file if format=csv is given.
+func (h *Handler) reviewExportHandler(w http.ResponseWriter, r *http.Request) {
+	if _, e := h.authorize(r, auth.FeatureReview); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	items := h.ReviewStore.Reviewed()
+
+	if r.URL.Query().Get("format") != "csv" {
+		SendReviewResponse(w, h, http.StatusOK, items)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="review.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	records := [][]string{{"id", "reference", "target", "similarity", "verdict", "created_at", "reviewed_at"}}
+	for _, item := range items {
+		reviewedAt := ""
+		if item.ReviewedAt != nil {
+			reviewedAt = item.ReviewedAt.Format(time.RFC3339)
+		}
+
+		records = append(records, []string{
+			item.ID,
+			item.Reference,
+			item.Target,
+			strconv.FormatFloat(item.Similarity, 'f', -1, 64),
+			string(item.Verdict),
+			item.CreatedAt.Format(time.RFC3339),
+			reviewedAt,
+		})
+	}
+
+	if err := writer.WriteAll(records); err != nil {
+		h.Logger.Error(err)
+	}
+}
+
+func reviewErrorCode(err error) string {
+	switch {
+	case errors.Is(err, review.ErrItemNotFound):
+		return CodeNotFound
+	case errors.Is(err, review.ErrWrongVerdict):
+		return CodeInvalidRequest
+	case errors.Is(err, review.ErrAlreadyJudged):
+		return CodeConflict
+	default:
+		return internalApp.CodeInternalError
+	}
+}
+
+func SendReviewResponse(w http.ResponseWriter, h *Handler, status int, items []review.Item) {
+	sendJSON(w, h, status, ReviewResponse{Items: items})
+}
@@ -1,22 +1,36 @@
 package http
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/spendmail/face_comparison/internal/auth"
+	"github.com/spendmail/face_comparison/internal/face"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
 type Config interface {
 	GetHTTPHost() string
 	GetHTTPPort() string
-	GetSecret() string
 	GetHealthCheckRouteTpl() string
 	GetFaceComparisonRouteTpl() string
+	GetFaceComparisonV2RouteTpl() string
+	GetReviewRouteTpl() string
+	GetJobsRouteTpl() string
+	GetBatchRouteTpl() string
+	GetAnalyzeRouteTpl() string
+	GetBatchMaxSets() int
+	GetBatchWorkers() int
+	GetAlwaysOK() bool
+	GetLimitBy() string
 }
 
 type Logger interface {
@@ -27,46 +41,116 @@ type Logger interface {
 }
 
 type Application interface {
-	CompareImages(urls []string) (string, []string, []string, []string, string, []error)
+	CompareImages(ctx context.Context, reference string, targets []string, options internalApp.Options) internalApp.ComparisonResult
+	AnalyzeImage(ctx context.Context, url string) internalApp.AnalysisResult
 }
 
 type Server struct {
 	Logger Logger
 	Server *http.Server
+	cancel context.CancelFunc
+}
+
+// Authenticator identifies the caller of a request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (auth.Client, error)
+}
+
+// Limiter admits the requests of a client within its rate and daily images quota.
+type Limiter interface {
+	Admit(client string, images int) error
+}
+
+// URLGuard keeps the urls called back by the service away from internal addresses.
+type URLGuard interface {
+	CheckURL(u *url.URL) error
+	CheckIP(ip net.IP) error
+}
+
+// Breaker reports the recognition backend circuit breaker state.
+type Breaker interface {
+	State() string
 }
 
 type Handler struct {
-	Config Config
-	App    Application
-	Logger Logger
+	Config      Config
+	App         Application
+	ReviewStore ReviewStore
+	Breaker     Breaker
+	Auth        Authenticator
+	Limiter     Limiter
+	Jobs        JobManager
+	Guard       URLGuard
+	Logger      Logger
 }
 
-func New(config Config, logger Logger, app Application) *Server {
+func New(
+	config Config,
+	logger Logger,
+	app Application,
+	reviewStore ReviewStore,
+	breaker Breaker,
+	authenticator Authenticator,
+	limiter Limiter,
+	jobManager JobManager,
+	guard URLGuard,
+) *Server {
 	handler := &Handler{
-		Config: config,
-		App:    app,
-		Logger: logger,
+		Config:      config,
+		App:         app,
+		ReviewStore: reviewStore,
+		Breaker:     breaker,
+		Auth:        authenticator,
+		Limiter:     limiter,
+		Jobs:        jobManager,
+		Guard:       guard,
+		Logger:      logger,
 	}
 
 	router := mux.NewRouter()
 	router.HandleFunc(config.GetHealthCheckRouteTpl(), handler.healthCheckHandler).Methods(http.MethodGet)
 	router.HandleFunc(config.GetFaceComparisonRouteTpl(), handler.compareHandler).Methods(http.MethodPost)
+	router.HandleFunc(config.GetFaceComparisonV2RouteTpl(), handler.compareV2Handler).Methods(http.MethodPost)
+	router.HandleFunc(config.GetBatchRouteTpl(), handler.batchHandler).Methods(http.MethodPost)
+	router.HandleFunc(config.GetAnalyzeRouteTpl(), handler.analyzeHandler).Methods(http.MethodPost)
+
+	reviewRoute := strings.TrimSuffix(config.GetReviewRouteTpl(), "/")
+	router.HandleFunc(reviewRoute+"/", handler.reviewListHandler).Methods(http.MethodGet)
+	router.HandleFunc(reviewRoute+"/export", handler.reviewExportHandler).Methods(http.MethodGet)
+	router.HandleFunc(reviewRoute+"/{id}", handler.reviewItemHandler).Methods(http.MethodGet)
+	router.HandleFunc(reviewRoute+"/{id}/verdict", handler.reviewVerdictHandler).Methods(http.MethodPost)
+
+	jobsRoute := strings.TrimSuffix(config.GetJobsRouteTpl(), "/")
+	router.HandleFunc(jobsRoute+"/", handler.jobSubmitHandler).Methods(http.MethodPost)
+	router.HandleFunc(jobsRoute+"/{id}", handler.jobGetHandler).Methods(http.MethodGet)
+	router.HandleFunc(jobsRoute+"/{id}", handler.jobCancelHandler).Methods(http.MethodDelete)
+
+	// Requests contexts are derived from the base one, so they're canceled when the server is stopped.
+	baseCtx, cancel := context.WithCancel(context.Background())
 
 	server := &http.Server{
 		Addr:    net.JoinHostPort(config.GetHTTPHost(), config.GetHTTPPort()),
 		Handler: router,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 
 	return &Server{
 		Logger: logger,
 		Server: server,
+		cancel: cancel,
 	}
 }
 
+// ComparisonRequest is taken by the comparison and the jobs routes, CallbackURL is used by the jobs only.
 type ComparisonRequest struct {
-	URLs []string `json:"urls"`
+	Reference   string   `json:"reference"`
+	URLs        []string `json:"urls"`
+	CallbackURL string   `json:"callback_url,omitempty"`
 }
 
+// ComparisonResponse is the v1 response, Target holds the reference image url.
 type ComparisonResponse struct {
 	Target        string   `json:"target"`
 	Unmatched     []string `json:"unmatched"`
@@ -76,21 +160,81 @@ type ComparisonResponse struct {
 	Gender        string   `json:"gender"`
 }
 
-var (
-	ErrWrongSecret = errors.New("wrong secret code")
-)
+// ComparisonResponseV2 reports every image separately, along with its status, scores and error code.
+type ComparisonResponseV2 struct {
+	Reference ImageResult     `json:"reference"`
+	Targets   []ImageResult   `json:"targets"`
+	Gender    string          `json:"gender"`
+	Errors    []ErrorResponse `json:"errors"`
+}
+
+// ImageResult is a status of a single input url.
+// Faces are reported for the compared targets only.
+type ImageResult struct {
+	URL            string       `json:"url"`
+	Status         string       `json:"status"`
+	Similarity     float64      `json:"similarity"`
+	SourceFace     *face.Face   `json:"source_face,omitempty"`
+	Matches        []face.Match `json:"matches,omitempty"`
+	UnmatchedFaces []face.Match `json:"unmatched_faces,omitempty"`
+	Attempts       int          `json:"attempts,omitempty"`
+	Code           string       `json:"code,omitempty"`
+	Error          string       `json:"error,omitempty"`
+}
+
+// split returns the reference url and the targets in the order they were sent.
+// The first url is used as the reference one unless it is set explicitly.
+func (cr ComparisonRequest) split() (string, []string) {
+	if cr.Reference == "" {
+		if len(cr.URLs) == 0 {
+			return "", []string{}
+		}
+
+		return cr.URLs[0], cr.URLs[1:]
+	}
+
+	targets := make([]string, 0, len(cr.URLs))
+	for _, url := range cr.URLs {
+		if url != cr.Reference {
+			targets = append(targets, url)
+		}
+	}
+
+	return cr.Reference, targets
+}
+
+// HealthCheckResponse is always sent with 200 OK while the service is up,
+// the status is degraded when the recognition backend isn't called because of the breaker.
+type HealthCheckResponse struct {
+	Status  string `json:"status"`
+	Breaker string `json:"breaker"`
+}
 
 func (h *Handler) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	bytes := []byte("OK")
-	w.Header().Set("Content-Type", http.DetectContentType(bytes))
+	rsp := HealthCheckResponse{
+		Status:  "ok",
+		Breaker: h.Breaker.State(),
+	}
+
+	if rsp.Breaker != internalApp.BreakerClosed {
+		rsp.Status = "degraded"
+	}
+
+	bytes, err := json.Marshal(rsp)
+	if err != nil {
+		h.Logger.Error(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
 	if _, err := w.Write(bytes); err != nil {
 		h.Logger.Error(err)
 	}
 }
 
+// compareHandler serves the v1 api, its response is kept as it was before the api got versioned.
 func (h *Handler) compareHandler(w http.ResponseWriter, r *http.Request) {
-	var cr ComparisonRequest
 	rsp := ComparisonResponse{
 		Unmatched:     make([]string, 0),
 		MultipleFaces: make([]string, 0),
@@ -98,39 +242,258 @@ func (h *Handler) compareHandler(w http.ResponseWriter, r *http.Request) {
 		Errors:        make([]string, 0),
 	}
 
-	// request decoding
-	err := json.NewDecoder(r.Body).Decode(&cr)
-	if err != nil {
-		rsp.Errors = []string{fmt.Sprintf("unable to decode the request: %s", err.Error())}
-		SendComparisonResponse(w, h, rsp)
+	// the body is decoded before authenticating the caller, as it always was
+	cr, e := readComparisonRequest(r)
+	if e != nil {
+		h.sendComparisonError(w, rsp, *e)
 		return
 	}
 
-	//secret checking
-	secret := r.URL.Query().Get("secret")
-	if secret != h.Config.GetSecret() {
-		rsp.Errors = []string{ErrWrongSecret.Error()}
-		SendComparisonResponse(w, h, rsp)
+	client, e := h.authorize(r, auth.FeatureCompare)
+	if e != nil {
+		h.sendComparisonError(w, rsp, *e)
+		return
+	}
+
+	if e := checkURLLimit(client, cr); e != nil {
+		h.sendComparisonError(w, rsp, *e)
+		return
+	}
+
+	// the legacy clients get the not enough images error of an invalid request, it costs nothing so it isn't admitted
+	reference, targets := cr.split()
+	if e := validateComparisonRequest(reference, targets); e != nil {
+		if !h.Config.GetAlwaysOK() {
+			SendError(w, h, *e)
+			return
+		}
+	} else if e := h.admit(r, client, len(targets)+1); e != nil {
+		h.sendComparisonError(w, rsp, *e)
 		return
 	}
 
 	// images processing
-	source, unmatched, multipleFaces, facesNotFound, gender, errs := h.App.CompareImages(cr.URLs)
+	result := h.App.CompareImages(r.Context(), reference, targets, comparisonOptions(client))
+
+	if failure, ok := comparisonFailure(result); ok && !h.Config.GetAlwaysOK() {
+		SendError(w, h, failure)
+		return
+	}
 
 	// converting errors to string
-	strErrs := make([]string, len(errs))
-	for i, err := range errs {
+	strErrs := make([]string, len(result.Errors))
+	for i, err := range result.Errors {
 		strErrs[i] = err.Error()
 	}
 
-	// renaming target as a source
-	rsp.Target = source
-	rsp.Unmatched = unmatched
-	rsp.MultipleFaces = multipleFaces
-	rsp.FacesNotFound = facesNotFound
-	rsp.Gender = gender
 	rsp.Errors = strErrs
 
+	// nothing but the errors is reported unless there were two images to compare at least
+	if notEnoughImages(result) {
+		SendComparisonResponse(w, h, rsp)
+		return
+	}
+
+	// renaming target as a source
+	rsp.Target = result.Reference.URL
+	rsp.Unmatched = unmatchedURLs(result)
+	rsp.MultipleFaces = result.MultipleFaces()
+	rsp.FacesNotFound = result.FacesNotFound()
+	rsp.Gender = result.Gender
+
+	SendComparisonResponse(w, h, rsp)
+}
+
+// compareV2Handler serves the v2 api, failures are always reported with the http status codes.
+// The results are streamed target by target if the client accepts ndjson or server-sent events.
+func (h *Handler) compareV2Handler(w http.ResponseWriter, r *http.Request) {
+	cr, client, e := h.decodeComparisonRequest(r)
+	if e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	reference, targets := cr.split()
+	if e := validateComparisonRequest(reference, targets); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	if e := h.admit(r, client, len(targets)+1); e != nil {
+		SendError(w, h, *e)
+		return
+	}
+
+	if format := streamFormat(r); format != "" {
+		h.streamComparison(w, r, format, reference, targets, comparisonOptions(client))
+		return
+	}
+
+	result := h.App.CompareImages(r.Context(), reference, targets, comparisonOptions(client))
+
+	if failure, ok := comparisonFailure(result); ok {
+		SendError(w, h, failure)
+		return
+	}
+
+	rsp := newComparisonResponseV2(result)
+	for _, e := range rsp.Errors {
+		h.Logger.Error(e.Message)
+	}
+
+	sendJSON(w, h, http.StatusOK, rsp)
+}
+
+// decodeComparisonRequest authenticates the caller first, since a signed request body is read to check it,
+// then decodes the request and checks it against the caller url limit.
+// The request is admitted by the handler once it's validated, so the rejected requests don't use up the quota.
+func (h *Handler) decodeComparisonRequest(r *http.Request) (ComparisonRequest, auth.Client, *ErrorResponse) {
+	// authentication
+	client, e := h.authorize(r, auth.FeatureCompare)
+	if e != nil {
+		return ComparisonRequest{}, client, e
+	}
+
+	cr, e := readComparisonRequest(r)
+	if e != nil {
+		return cr, client, e
+	}
+
+	return cr, client, checkURLLimit(client, cr)
+}
+
+// readComparisonRequest decodes the body and puts it back, so a signed request can still be checked after that.
+func readComparisonRequest(r *http.Request) (ComparisonRequest, *ErrorResponse) {
+	var cr ComparisonRequest
+
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		err = json.NewDecoder(bytes.NewReader(body)).Decode(&cr)
+	}
+
+	if err != nil {
+		return cr, &ErrorResponse{
+			Code:    CodeInvalidRequest,
+			Message: fmt.Sprintf("unable to decode the request: %s", err.Error()),
+		}
+	}
+
+	return cr, nil
+}
+
+// checkURLLimit checks the request against the number of urls the caller may send at once.
+func checkURLLimit(client auth.Client, cr ComparisonRequest) *ErrorResponse {
+	_, targets := cr.split()
+	if client.MaxURLs > 0 && len(targets)+1 > client.MaxURLs {
+		return &ErrorResponse{
+			Code:    CodeTooManyURLs,
+			Message: fmt.Sprintf("%d urls are allowed at most", client.MaxURLs),
+		}
+	}
+
+	return nil
+}
+
+func validateComparisonRequest(reference string, targets []string) *ErrorResponse {
+	if reference == "" || len(targets) == 0 {
+		return &ErrorResponse{
+			Code:    CodeInvalidRequest,
+			Message: "a reference and at least one target url are required",
+		}
+	}
+
+	return nil
+}
+
+func notEnoughImages(result internalApp.ComparisonResult) bool {
+	for _, err := range result.Errors {
+		if internalApp.ErrorCode(err) == internalApp.CodeNotEnoughImages {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unmatchedURLs returns the targets below the similarity threshold, v1 doesn't tell borderline ones apart.
+func unmatchedURLs(result internalApp.ComparisonResult) []string {
+	urls := make([]string, 0, len(result.Targets))
+	for _, t := range result.Targets {
+		if t.Status == internalApp.StatusUnmatched || t.Status == internalApp.StatusBorderline {
+			urls = append(urls, t.URL)
+		}
+	}
+
+	return urls
+}
+
+func newComparisonResponseV2(result internalApp.ComparisonResult) ComparisonResponseV2 {
+	images := newImageResults(result.Images())
+
+	rsp := ComparisonResponseV2{
+		Reference: images[0],
+		Targets:   images[1:],
+		Gender:    result.Gender,
+		Errors:    make([]ErrorResponse, len(result.Errors)),
+	}
+
+	for i, err := range result.Errors {
+		rsp.Errors[i] = ErrorResponse{Code: internalApp.ErrorCode(err), Message: err.Error()}
+
+		// errors of single images keep their urls
+		for _, image := range result.Images() {
+			if image.Err == err {
+				rsp.Errors[i].Code = image.Code
+				rsp.Errors[i].URL = image.URL
+				break
+			}
+		}
+	}
+
+	return rsp
+}
+
+func newImageResults(images []internalApp.ImageResult) []ImageResult {
+	results := make([]ImageResult, len(images))
+	for i, image := range images {
+		results[i] = ImageResult{
+			URL:        image.URL,
+			Status:     string(image.Status),
+			Similarity: image.Similarity,
+			Attempts:   image.Attempts,
+			Code:       image.Code,
+		}
+
+		if image.Comparison != nil {
+			results[i].SourceFace = &image.Comparison.SourceFace
+			results[i].Matches = image.Comparison.Matches
+			results[i].UnmatchedFaces = image.Comparison.UnmatchedFaces
+		}
+
+		if image.Err != nil {
+			results[i].Error = image.Err.Error()
+		}
+	}
+
+	return results
+}
+
+// sendComparisonError sends the error as a comparison response in the legacy always 200 OK mode.
+func (h *Handler) sendComparisonError(w http.ResponseWriter, rsp ComparisonResponse, e ErrorResponse) {
+	if !h.Config.GetAlwaysOK() {
+		SendError(w, h, e)
+		return
+	}
+
+	setRetryAfter(w, e)
+
+	rsp.Errors = []string{e.Message}
+	if e.Code == CodeUnauthorized || e.Code == CodeForbidden {
+		// legacy clients know the only auth error
+		rsp.Errors = []string{auth.ErrWrongSecret.Error()}
+	}
+
 	SendComparisonResponse(w, h, rsp)
 }
 
@@ -150,10 +513,22 @@ func SendComparisonResponse(w http.ResponseWriter, h *Handler, rsp ComparisonRes
 	}
 }
 
+func sendJSON(w http.ResponseWriter, h *Handler, status int, rsp interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		h.Logger.Error(err)
+	}
+}
+
 func (s *Server) Start() error {
 	return s.Server.ListenAndServe()
 }
 
+// Stop waits for the active requests until ctx is done, then the requests left are canceled.
 func (s *Server) Stop(ctx context.Context) error {
+	defer s.cancel()
+
 	return s.Server.Shutdown(ctx)
 }
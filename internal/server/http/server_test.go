@@ -0,0 +1,1025 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/spendmail/face_comparison/internal/auth"
+	"github.com/spendmail/face_comparison/internal/face"
+	"github.com/spendmail/face_comparison/internal/jobs"
+	"github.com/spendmail/face_comparison/internal/quota"
+	"github.com/spendmail/face_comparison/internal/review"
+	"github.com/spendmail/face_comparison/internal/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(args ...interface{}) {}
+func (nopLogger) Info(args ...interface{})  {}
+func (nopLogger) Warn(args ...interface{})  {}
+func (nopLogger) Error(args ...interface{}) {}
+
+type fakeConfig struct {
+	// statusCodes turns off the default v1 always OK behaviour
+	statusCodes bool
+	signed      bool
+	jwtKeyFile  string
+	keysFile    string
+	rate        float64
+	perDay      int
+}
+
+func (fakeConfig) GetHTTPHost() string                 { return "localhost" }
+func (fakeConfig) GetHTTPPort() string                 { return "0" }
+func (fakeConfig) GetSecret() string                   { return "secret" }
+func (fakeConfig) GetHealthCheckRouteTpl() string      { return "/health-check/" }
+func (fakeConfig) GetFaceComparisonRouteTpl() string   { return "/v1/compare/" }
+func (fakeConfig) GetFaceComparisonV2RouteTpl() string { return "/v2/compare/" }
+func (fakeConfig) GetReviewRouteTpl() string           { return "/review/" }
+func (fakeConfig) GetJobsRouteTpl() string             { return "/jobs/" }
+func (fakeConfig) GetBatchRouteTpl() string            { return "/v2/batch/" }
+func (fakeConfig) GetAnalyzeRouteTpl() string          { return "/analyze/" }
+func (fakeConfig) GetBatchMaxSets() int                { return 3 }
+func (fakeConfig) GetBatchWorkers() int                { return 2 }
+func (c fakeConfig) GetAlwaysOK() bool                 { return !c.statusCodes }
+func (fakeConfig) GetQuerySecret() bool                { return true }
+func (fakeConfig) GetWebhookSecret() string            { return "" }
+func (fakeConfig) GetWebhookOutboxFile() string        { return "" }
+func (fakeConfig) GetWebhookTimeout() time.Duration    { return time.Second }
+func (fakeConfig) GetWebhookMaxAttempts() int          { return 1 }
+func (fakeConfig) GetWebhookBackoff() time.Duration    { return time.Second }
+func (fakeConfig) GetWebhookMaxBackoff() time.Duration { return time.Second }
+func (fakeConfig) GetWebhookWorkers() int              { return 1 }
+func (fakeConfig) GetWebhookAllowedNetworks() []string { return nil }
+func (fakeConfig) GetWebhookAllowedDomains() []string  { return nil }
+func (fakeConfig) GetWebhookDeniedDomains() []string   { return []string{"internal.example"} }
+
+// the download lists don't apply to the callbacks
+func (fakeConfig) GetDownloadAllowedNetworks() []string { return []string{"127.0.0.0/8"} }
+func (fakeConfig) GetDownloadAllowedDomains() []string  { return []string{"cdn.example"} }
+func (fakeConfig) GetDownloadDeniedDomains() []string   { return []string{"partner.example"} }
+func (fakeConfig) GetAPIKeys() []string {
+	return []string{"partner:key", "expired:old:2020-01-01T00:00:00Z"}
+}
+func (c fakeConfig) GetAPIKeysFile() string             { return c.keysFile }
+func (c fakeConfig) GetSignedRequests() bool            { return c.signed }
+func (fakeConfig) GetSignatureMaxAge() time.Duration    { return time.Minute }
+func (fakeConfig) GetNonceWindow() int                  { return 10 }
+func (c fakeConfig) GetJWTHMACKeyFile() string          { return c.jwtKeyFile }
+func (fakeConfig) GetJWTPublicKeyFiles() []string       { return nil }
+func (fakeConfig) GetJWTJWKSFile() string               { return "" }
+func (fakeConfig) GetJWTIssuer() string                 { return "" }
+func (fakeConfig) GetJWTAudience() string               { return "" }
+func (fakeConfig) GetLimitBy() string                   { return LimitByKey }
+func (c fakeConfig) GetRequestsRate() float64           { return c.rate }
+func (fakeConfig) GetRequestsBurst() int                { return 1 }
+func (c fakeConfig) GetImagesPerDay() int               { return c.perDay }
+func (fakeConfig) GetQuotaFile() string                 { return "" }
+func (fakeConfig) GetQuotaFlushInterval() time.Duration { return 0 }
+func (fakeConfig) GetJobWorkers() int                   { return 1 }
+func (fakeConfig) GetJobQueueSize() int                 { return 10 }
+func (fakeConfig) GetJobResultTTL() time.Duration       { return time.Hour }
+
+func newTestServer(t *testing.T, config fakeConfig) *Server {
+	t.Helper()
+
+	return newTestServerWithReview(t, config, nil)
+}
+
+func newTestServerWithReview(t *testing.T, config fakeConfig, reviewStore ReviewStore) *Server {
+	t.Helper()
+
+	authenticator, err := auth.New(config)
+	require.NoError(t, err)
+
+	limiter, err := quota.New(config, nopLogger{})
+	require.NoError(t, err)
+
+	jobManager := jobs.New(config, fakeApplication{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		jobManager.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	guard, err := webhook.NewGuard(config)
+	require.NoError(t, err)
+
+	return New(config, nopLogger{}, fakeApplication{}, reviewStore, fakeBreaker{}, authenticator, limiter, jobManager, guard)
+}
+
+type fakeBreaker struct{}
+
+func (fakeBreaker) State() string { return internalApp.BreakerClosed }
+
+// fakeApplication fails every target with the error named by its url, e.g. "rate_limited".
+type fakeApplication struct{}
+
+var fakeErrors = map[string]error{
+	"rate_limited":  internalApp.ErrRateLimited,
+	"unavailable":   internalApp.ErrBreakerOpen,
+	"not_supported": internalApp.ErrFileNotSupported,
+}
+
+func (fakeApplication) CompareImages(ctx context.Context, reference string, targets []string, options internalApp.Options) internalApp.ComparisonResult {
+	result := internalApp.ComparisonResult{
+		Reference: internalApp.ImageResult{URL: reference, Status: internalApp.StatusReference},
+	}
+
+	if !options.SkipGender {
+		result.Gender = "male"
+	}
+
+	if err, ok := fakeErrors[reference]; ok {
+		result.Reference.Err = err
+		result.Errors = append(result.Errors, fmt.Errorf("%w: reference failed", internalApp.ErrNotEnoughImage))
+		return result
+	}
+
+	if len(targets) == 0 {
+		// the application answers so before doing anything
+		result.Errors = append(result.Errors, internalApp.ErrNotEnoughImage)
+		return result
+	}
+
+	for _, url := range targets {
+		target := internalApp.ImageResult{URL: url, Status: internalApp.StatusMatched}
+		if err, ok := fakeErrors[url]; ok {
+			target.Status, target.Code, target.Err = internalApp.StatusBackendError, internalApp.ErrorCode(err), err
+			result.Errors = append(result.Errors, err)
+		}
+		result.Targets = append(result.Targets, target)
+	}
+
+	// reported in the reverse order, as if the last target was the fastest one
+	if options.OnTarget != nil {
+		for i := len(result.Targets) - 1; i >= 0; i-- {
+			options.OnTarget(i, result.Targets[i])
+		}
+	}
+
+	return result
+}
+
+// AnalyzeImage finds a single face unless the url names an error.
+func (fakeApplication) AnalyzeImage(ctx context.Context, url string) internalApp.AnalysisResult {
+	if err, ok := fakeErrors[url]; ok {
+		return internalApp.AnalysisResult{URL: url, Faces: []face.Details{}, Code: internalApp.ErrorCode(err), Err: err}
+	}
+
+	return internalApp.AnalysisResult{URL: url, Faces: []face.Details{{Gender: face.Gender{Value: "male", Confidence: 99}}}}
+}
+
+func TestCompareHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		body   string
+		status int
+		code   string
+		url    string
+	}{
+		{name: "ok", query: "?secret=secret", body: `{"urls": ["a", "b", "rate_limited"]}`, status: http.StatusOK},
+		{name: "malformed json", query: "?secret=secret", body: `{"urls": `, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "no secret", body: `{"urls": ["a", "b"]}`, status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "wrong secret", query: "?secret=wrong", body: `{"urls": ["a", "b"]}`, status: http.StatusForbidden, code: CodeForbidden},
+		{name: "single image", query: "?secret=secret", body: `{"urls": ["a"]}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{
+			name: "unusable reference", query: "?secret=secret", body: `{"urls": ["not_supported", "a"]}`,
+			status: http.StatusUnprocessableEntity, code: internalApp.CodeNotEnoughImages, url: "not_supported",
+		},
+		{
+			name: "rate limited", query: "?secret=secret", body: `{"urls": ["a", "rate_limited"]}`,
+			status: http.StatusTooManyRequests, code: internalApp.CodeRateLimited, url: "rate_limited",
+		},
+		{
+			name: "backend outage", query: "?secret=secret", body: `{"urls": ["a", "unavailable", "rate_limited"]}`,
+			status: http.StatusServiceUnavailable, code: internalApp.CodeBreakerOpen, url: "unavailable",
+		},
+	}
+
+	for _, alwaysOK := range []bool{false, true} {
+		server := newTestServer(t, fakeConfig{statusCodes: !alwaysOK})
+
+		for _, tt := range tests {
+			tt := tt
+			t.Run(fmt.Sprintf("%s, always ok %t", tt.name, alwaysOK), func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodPost, "/v1/compare/"+tt.query, strings.NewReader(tt.body))
+				w := httptest.NewRecorder()
+				server.Server.Handler.ServeHTTP(w, r)
+
+				if alwaysOK || tt.status == http.StatusOK {
+					require.Equal(t, http.StatusOK, w.Code)
+
+					var rsp ComparisonResponse
+					require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+					if tt.status != http.StatusOK {
+						require.NotEmpty(t, rsp.Errors)
+					}
+					return
+				}
+
+				require.Equal(t, tt.status, w.Code)
+
+				var rsp ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+				require.Equal(t, tt.code, rsp.Code)
+				require.Equal(t, tt.url, rsp.URL)
+				require.NotEmpty(t, rsp.Message)
+			})
+		}
+	}
+}
+
+func TestComparisonFailureCanceled(t *testing.T) {
+	canceled := internalApp.ImageResult{URL: "a", Status: internalApp.StatusSkipped, Code: internalApp.CodeCanceled, Err: errors.New("canceled")}
+
+	_, failed := comparisonFailure(internalApp.ComparisonResult{Targets: []internalApp.ImageResult{canceled}})
+	require.False(t, failed)
+}
+
+func TestCompareHandlerV1Schema(t *testing.T) {
+	server := newTestServer(t, fakeConfig{})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/compare/?secret=secret", strings.NewReader(`{"urls": ["a", "b", "rate_limited"]}`))
+	w := httptest.NewRecorder()
+	server.Server.Handler.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t,
+		`{"target":"a","unmatched":[],"multiple_faces":[],"faces_not_found":[],"errors":["recognition rate limit exceeded"],"gender":"male"}`+"\n",
+		w.Body.String(),
+	)
+}
+
+// v1 clients rely on 200 OK with the errors in the body, this is kept unless turned off.
+func TestCompareHandlerV1WrongSecret(t *testing.T) {
+	server := newTestServer(t, fakeConfig{})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/compare/?secret=wrong", strings.NewReader(`{"urls": ["a", "b"]}`))
+	w := httptest.NewRecorder()
+	server.Server.Handler.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t,
+		`{"target":"","unmatched":[],"multiple_faces":[],"faces_not_found":[],"errors":["wrong secret code"],"gender":""}`+"\n",
+		w.Body.String(),
+	)
+}
+
+// the responses the v1 clients got before the api was versioned
+func TestCompareHandlerV1Golden(t *testing.T) {
+	server := newTestServer(t, fakeConfig{})
+
+	tests := []struct {
+		name, query, body, expected string
+	}{
+		{
+			name: "single url", query: "?secret=secret", body: `{"urls": ["a"]}`,
+			expected: `{"target":"","unmatched":[],"multiple_faces":[],"faces_not_found":[],"errors":["not enough images to compare"],"gender":""}`,
+		},
+		{
+			name: "failed reference", query: "?secret=secret", body: `{"urls": ["unavailable", "b"]}`,
+			expected: `{"target":"","unmatched":[],"multiple_faces":[],"faces_not_found":[],"errors":["not enough images to compare: reference failed"],"gender":""}`,
+		},
+		{
+			name: "malformed body, wrong secret", query: "?secret=wrong", body: `{"urls": [`,
+			expected: `{"target":"","unmatched":[],"multiple_faces":[],"faces_not_found":[],"errors":["unable to decode the request: unexpected EOF"],"gender":""}`,
+		},
+		{
+			name: "empty body, no secret", body: ``,
+			expected: `{"target":"","unmatched":[],"multiple_faces":[],"faces_not_found":[],"errors":["unable to decode the request: EOF"],"gender":""}`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/compare/"+tt.query, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(w, r)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.expected+"\n", w.Body.String())
+		})
+	}
+}
+
+func TestCompareHandlerV2(t *testing.T) {
+	for _, alwaysOK := range []bool{false, true} {
+		server := newTestServer(t, fakeConfig{statusCodes: !alwaysOK})
+
+		t.Run(fmt.Sprintf("ok, always ok %t", alwaysOK), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v2/compare/?secret=secret", strings.NewReader(`{"reference": "a", "urls": ["b", "rate_limited"]}`))
+			w := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var rsp ComparisonResponseV2
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+			require.Equal(t, "a", rsp.Reference.URL)
+			require.Len(t, rsp.Targets, 2)
+			require.Equal(t, string(internalApp.StatusMatched), rsp.Targets[0].Status)
+			require.Equal(t, internalApp.CodeRateLimited, rsp.Targets[1].Code)
+			require.Equal(t, []ErrorResponse{{
+				Code:    internalApp.CodeRateLimited,
+				Message: internalApp.ErrRateLimited.Error(),
+				URL:     "rate_limited",
+			}}, rsp.Errors)
+		})
+
+		// the compatibility switch is for v1 clients only
+		t.Run(fmt.Sprintf("failure, always ok %t", alwaysOK), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v2/compare/?secret=wrong", strings.NewReader(`{"urls": ["a", "b"]}`))
+			w := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(w, r)
+			require.Equal(t, http.StatusForbidden, w.Code)
+		})
+	}
+}
+
+func TestCompareHandlerAuth(t *testing.T) {
+	server := newTestServer(t, fakeConfig{})
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{name: "api key", header: http.Header{"X-Api-Key": {"key"}}, status: http.StatusOK},
+		{name: "authorization", header: http.Header{"Authorization": {"ApiKey key"}}, status: http.StatusOK},
+		{name: "shared secret", header: http.Header{"Authorization": {"Bearer secret"}}, status: http.StatusOK},
+		{name: "unknown key", header: http.Header{"X-Api-Key": {"other"}}, status: http.StatusForbidden},
+		{name: "expired key", header: http.Header{"X-Api-Key": {"old"}}, status: http.StatusForbidden},
+		{name: "no key", header: http.Header{}, status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v2/compare/", strings.NewReader(`{"urls": ["a", "b"]}`))
+			r.Header = tt.header
+			w := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(w, r)
+			require.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestCompareHandlerSigned(t *testing.T) {
+	server := newTestServer(t, fakeConfig{signed: true})
+
+	body := `{"urls": ["a", "b"]}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// v1 decodes the body before the signature is checked
+	for _, path := range []string{"/v1/compare/", "/v2/compare/"} {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set(auth.HeaderKeyID, "partner")
+		r.Header.Set(auth.HeaderTimestamp, timestamp)
+		r.Header.Set(auth.HeaderNonce, "nonce"+path)
+		r.Header.Set(auth.HeaderSignature, auth.Sign("key", http.MethodPost, path, timestamp, "nonce"+path, []byte(body)))
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code, path)
+		require.NotContains(t, w.Body.String(), auth.ErrWrongSecret.Error(), path)
+	}
+}
+
+// hs256Token signs the claims with the "jwt-secret" key.
+func hs256Token(claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+
+	mac := hmac.New(sha256.New, []byte("jwt-secret"))
+	mac.Write([]byte(header + "." + payload))
+
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestCompareHandlerJWT(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "jwt.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("jwt-secret"), 0o600))
+
+	server := newTestServer(t, fakeConfig{jwtKeyFile: keyFile})
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		claims string
+		urls   string
+		status int
+		code   string
+		gender string
+	}{
+		{
+			name:   "default features",
+			claims: fmt.Sprintf(`{"sub": "partner", "exp": %d}`, exp),
+			urls:   `["a", "b", "c"]`, status: http.StatusOK, gender: "male",
+		},
+		{
+			name:   "no gender",
+			claims: fmt.Sprintf(`{"sub": "partner", "exp": %d, "allowed_features": ["compare"]}`, exp),
+			urls:   `["a", "b"]`, status: http.StatusOK,
+		},
+		{
+			name:   "no compare",
+			claims: fmt.Sprintf(`{"sub": "partner", "exp": %d, "allowed_features": ["review"]}`, exp),
+			urls:   `["a", "b"]`, status: http.StatusForbidden, code: CodeForbidden,
+		},
+		{
+			name:   "too many urls",
+			claims: fmt.Sprintf(`{"sub": "partner", "exp": %d, "max_urls": 2}`, exp),
+			urls:   `["a", "b", "c"]`, status: http.StatusForbidden, code: CodeTooManyURLs,
+		},
+		{
+			name:   "expired",
+			claims: fmt.Sprintf(`{"sub": "partner", "exp": %d}`, time.Now().Add(-time.Hour).Unix()),
+			urls:   `["a", "b"]`, status: http.StatusForbidden, code: CodeForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v2/compare/", strings.NewReader(`{"urls": `+tt.urls+`}`))
+			r.Header.Set("Authorization", "Bearer "+hs256Token(tt.claims))
+			w := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(w, r)
+			require.Equal(t, tt.status, w.Code)
+
+			if tt.status != http.StatusOK {
+				var rsp ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+				require.Equal(t, tt.code, rsp.Code)
+				return
+			}
+
+			var rsp ComparisonResponseV2
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+			require.Equal(t, tt.gender, rsp.Gender)
+		})
+	}
+}
+
+func TestCompareHandlerLimits(t *testing.T) {
+	compare := func(server *Server, key, urls string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v2/compare/", strings.NewReader(`{"urls": `+urls+`}`))
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("requests rate", func(t *testing.T) {
+		server := newTestServer(t, fakeConfig{rate: 0.5})
+
+		require.Equal(t, http.StatusOK, compare(server, "key", `["a", "b"]`).Code)
+
+		w := compare(server, "key", `["a", "b"]`)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "2", w.Header().Get("Retry-After"))
+
+		// the other client has its own limit
+		require.Equal(t, http.StatusOK, compare(server, "secret", `["a", "b"]`).Code)
+	})
+
+	t.Run("images per day", func(t *testing.T) {
+		server := newTestServer(t, fakeConfig{perDay: 5})
+
+		require.Equal(t, http.StatusOK, compare(server, "key", `["a", "b", "c"]`).Code)
+
+		w := compare(server, "key", `["a", "b", "c"]`)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+		var rsp ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+		require.Equal(t, CodeQuotaExceeded, rsp.Code)
+
+		// the rejected request doesn't use up the quota
+		require.Equal(t, http.StatusOK, compare(server, "key", `["a", "b"]`).Code)
+	})
+	t.Run("invalid requests", func(t *testing.T) {
+		server := newTestServer(t, fakeConfig{rate: 0.5, perDay: 2})
+
+		// requests rejected with 400 are not admitted at all
+		require.Equal(t, http.StatusBadRequest, compare(server, "key", `["a"]`).Code)
+		require.Equal(t, http.StatusBadRequest, compare(server, "key", `[]`).Code)
+		require.Equal(t, http.StatusOK, compare(server, "key", `["a", "b"]`).Code)
+	})
+}
+
+func TestJobHandlers(t *testing.T) {
+	server := newTestServer(t, fakeConfig{})
+
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	w := send(http.MethodPost, "/jobs/", "key", `{"reference": "a", "urls": ["b", "rate_limited"]}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	var submitted JobResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&submitted))
+	require.Equal(t, "/jobs/"+submitted.ID, w.Header().Get("Location"))
+
+	t.Run("result", func(t *testing.T) {
+		var rsp JobResponse
+		require.Eventually(t, func() bool {
+			w := send(http.MethodGet, "/jobs/"+submitted.ID, "key", "")
+			require.Equal(t, http.StatusOK, w.Code)
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+			return rsp.Status == jobs.StatusDone
+		}, time.Second, 10*time.Millisecond)
+
+		require.NotNil(t, rsp.Result)
+		require.Equal(t, "male", rsp.Result.Gender)
+		require.Len(t, rsp.Result.Targets, 2)
+		require.Nil(t, rsp.Error)
+	})
+
+	t.Run("other owner", func(t *testing.T) {
+		w := send(http.MethodGet, "/jobs/"+submitted.ID, "secret", "")
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		w = send(http.MethodDelete, "/jobs/"+submitted.ID, "secret", "")
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("finished job", func(t *testing.T) {
+		w := send(http.MethodDelete, "/jobs/"+submitted.ID, "key", "")
+		require.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		w := send(http.MethodPost, "/jobs/", "key", `{"urls": ["a"]}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("callback url", func(t *testing.T) {
+		w := send(http.MethodPost, "/jobs/", "key", `{"urls": ["a", "b"], "callback_url": "ftp://callback"}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		// the test server has no notifier
+		w = send(http.MethodPost, "/jobs/", "key", `{"urls": ["a", "b"], "callback_url": "https://callback"}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	// loopback is blocked although the downloads are allowed to reach it
+	t.Run("internal callback url", func(t *testing.T) {
+		for _, callbackURL := range []string{
+			"http://127.0.0.1:8080/hook",
+			"http://[::1]/hook",
+			"http://169.254.169.254/latest/meta-data/",
+			"https://hooks.internal.example/hook",
+		} {
+			w := send(http.MethodPost, "/jobs/", "key", `{"urls": ["a", "b"], "callback_url": "`+callbackURL+`"}`)
+			require.Equal(t, http.StatusUnprocessableEntity, w.Code, callbackURL)
+
+			var rsp ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+			require.Equal(t, internalApp.CodeBlocked, rsp.Code)
+			require.Equal(t, callbackURL, rsp.URL)
+		}
+	})
+
+	t.Run("callback host outside the download lists", func(t *testing.T) {
+		w := send(http.MethodPost, "/jobs/", "key", `{"urls": ["a", "b"], "callback_url": "https://partner.example/hook"}`)
+
+		// the test server has no notifier, the url itself passes
+		var rsp ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+		require.Equal(t, CodeInvalidRequest, rsp.Code)
+		require.Equal(t, jobs.ErrNoCallbacks.Error(), rsp.Message)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		w := send(http.MethodPost, "/jobs/", "", `{"urls": ["a", "b"]}`)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+type fakeOutbox struct {
+	url     string
+	payload []byte
+}
+
+func (o *fakeOutbox) Enqueue(url string, payload []byte) error {
+	o.url, o.payload = url, payload
+	return nil
+}
+
+func TestJobNotifier(t *testing.T) {
+	outbox := &fakeOutbox{}
+	result := fakeApplication{}.CompareImages(context.Background(), "a", []string{"b"}, internalApp.Options{})
+
+	NewJobNotifier(outbox, nopLogger{}).Notify(jobs.Job{
+		ID:          "id",
+		Status:      jobs.StatusDone,
+		CallbackURL: "https://callback",
+		Result:      &result,
+	})
+
+	require.Equal(t, "https://callback", outbox.url)
+
+	var rsp JobResponse
+	require.NoError(t, json.Unmarshal(outbox.payload, &rsp))
+	require.Equal(t, "id", rsp.ID)
+	require.Equal(t, jobs.StatusDone, rsp.Status)
+	require.NotNil(t, rsp.Result)
+	require.Equal(t, "male", rsp.Result.Gender)
+}
+
+func TestCompareHandlerStream(t *testing.T) {
+	server := newTestServer(t, fakeConfig{})
+
+	compare := func(accept, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v2/compare/", strings.NewReader(body))
+		r.Header.Set("X-API-Key", "key")
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		w := compare("application/json, application/x-ndjson;q=0.9", `{"reference": "a", "urls": ["b", "rate_limited"]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, MimeNDJSON, w.Header().Get("Content-Type"))
+
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		require.Len(t, lines, 3)
+
+		var target struct {
+			Event string      `json:"event"`
+			Data  TargetEvent `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &target))
+		require.Equal(t, EventTarget, target.Event)
+		require.Equal(t, 1, target.Data.Index)
+		require.Equal(t, "rate_limited", target.Data.URL)
+		require.Equal(t, internalApp.CodeRateLimited, target.Data.Code)
+
+		var summary struct {
+			Event string       `json:"event"`
+			Data  SummaryEvent `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(lines[2]), &summary))
+		require.Equal(t, EventSummary, summary.Event)
+		require.Equal(t, "a", summary.Data.Reference.URL)
+		require.Equal(t, "male", summary.Data.Gender)
+		require.Len(t, summary.Data.Errors, 1)
+		require.Nil(t, summary.Data.Error)
+	})
+
+	t.Run("server-sent events", func(t *testing.T) {
+		w := compare("text/event-stream", `{"reference": "a", "urls": ["b"]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, MimeEventStream, w.Header().Get("Content-Type"))
+
+		events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+		require.Len(t, events, 2)
+		require.True(t, strings.HasPrefix(events[0], "event: target\ndata: {"), events[0])
+		require.True(t, strings.HasPrefix(events[1], "event: summary\ndata: {"), events[1])
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		w := compare("application/x-ndjson", `{"reference": "unavailable", "urls": ["b"]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+
+		var summary struct {
+			Data SummaryEvent `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &summary))
+		require.NotNil(t, summary.Data.Error)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		w := compare("application/x-ndjson", `{"urls": ["a"]}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestBatchHandler(t *testing.T) {
+	batch := func(server *Server, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v2/batch/", strings.NewReader(body))
+		r.Header.Set("X-API-Key", "key")
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("results by set", func(t *testing.T) {
+		w := batch(newTestServer(t, fakeConfig{}), `[
+			{"id": "ok", "reference": "a", "urls": ["b", "rate_limited"]},
+			{"id": "failed", "reference": "unavailable", "urls": ["b"]},
+			{"id": "invalid", "urls": ["a"]}
+		]`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var rsp BatchResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+		require.Len(t, rsp.Results, 3)
+
+		ok := rsp.Results["ok"]
+		require.Nil(t, ok.Error)
+		require.Equal(t, "male", ok.Result.Gender)
+		require.Len(t, ok.Result.Targets, 2)
+		require.Len(t, ok.Result.Errors, 1)
+
+		failed := rsp.Results["failed"]
+		require.NotNil(t, failed.Error)
+		require.Equal(t, internalApp.CodeNotEnoughImages, failed.Error.Code)
+		require.Equal(t, "unavailable", failed.Error.URL)
+		require.NotNil(t, failed.Result)
+
+		invalid := rsp.Results["invalid"]
+		require.Nil(t, invalid.Result)
+		require.Equal(t, CodeInvalidRequest, invalid.Error.Code)
+	})
+
+	t.Run("rejected batch", func(t *testing.T) {
+		server := newTestServer(t, fakeConfig{})
+
+		tests := []struct {
+			name string
+			body string
+		}{
+			{name: "malformed json", body: `[{"id": `},
+			{name: "no sets", body: `[]`},
+			{name: "too many sets", body: `[{"id": "1"}, {"id": "2"}, {"id": "3"}, {"id": "4"}]`},
+			{name: "no id", body: `[{"urls": ["a", "b"]}]`},
+			{name: "duplicate id", body: `[{"id": "1", "urls": ["a", "b"]}, {"id": "1", "urls": ["a", "c"]}]`},
+		}
+
+		for _, tt := range tests {
+			tt := tt
+			t.Run(tt.name, func(t *testing.T) {
+				w := batch(server, tt.body)
+				require.Equal(t, http.StatusBadRequest, w.Code)
+			})
+		}
+	})
+
+	t.Run("images quota", func(t *testing.T) {
+		server := newTestServer(t, fakeConfig{perDay: 5})
+
+		w := batch(server, `[{"id": "1", "urls": ["a", "b"]}, {"id": "2", "urls": ["a", "b", "c"]}]`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = batch(server, `[{"id": "1", "urls": ["a", "b"]}]`)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+}
+
+func TestAnalyzeHandler(t *testing.T) {
+	server := newTestServer(t, fakeConfig{})
+
+	tests := []struct {
+		name   string
+		key    string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "ok", key: "key", body: `{"url": "a"}`, status: http.StatusOK},
+		{name: "unsupported image", key: "key", body: `{"url": "not_supported"}`, status: http.StatusUnprocessableEntity, code: internalApp.CodeUnsupportedType},
+		{name: "backend unavailable", key: "key", body: `{"url": "unavailable"}`, status: http.StatusServiceUnavailable, code: internalApp.CodeBreakerOpen},
+		{name: "no url", key: "key", body: `{}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "malformed json", key: "key", body: `{"url": `, status: http.StatusBadRequest, code: CodeInvalidRequest},
+		{name: "no key", body: `{"url": "a"}`, status: http.StatusUnauthorized, code: CodeUnauthorized},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/analyze/", strings.NewReader(tt.body))
+			if tt.key != "" {
+				r.Header.Set("X-API-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(w, r)
+			require.Equal(t, tt.status, w.Code)
+
+			if tt.status != http.StatusOK {
+				var rsp ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+				require.Equal(t, tt.code, rsp.Code)
+				return
+			}
+
+			var rsp AnalyzeResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+			require.Equal(t, "a", rsp.URL)
+			require.Len(t, rsp.Faces, 1)
+			require.Equal(t, "male", rsp.Faces[0].Gender.Value)
+		})
+	}
+}
+
+type reviewConfig struct{}
+
+func (reviewConfig) GetReviewFile() string { return "" }
+
+func (reviewConfig) GetReviewRetention() time.Duration { return 0 }
+
+func TestReviewHandlers(t *testing.T) {
+	store, err := review.New(reviewConfig{})
+	require.NoError(t, err)
+
+	pending, err := store.Add("reference", "pending", 80)
+	require.NoError(t, err)
+	judged, err := store.Add("reference", "judged", 75.5)
+	require.NoError(t, err)
+
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(keysFile, []byte(`[{"name": "reviewer", "key": "reviewer", "features": ["review"]}]`), 0o600))
+
+	jwtKeyFile := filepath.Join(t.TempDir(), "jwt.key")
+	require.NoError(t, os.WriteFile(jwtKeyFile, []byte("jwt-secret"), 0o600))
+
+	server := newTestServerWithReview(t, fakeConfig{keysFile: keysFile, jwtKeyFile: jwtKeyFile}, store)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-API-Key", "reviewer")
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) []review.Item {
+		t.Helper()
+
+		var rsp ReviewResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+
+		return rsp.Items
+	}
+
+	t.Run("verdict", func(t *testing.T) {
+		w := send(http.MethodPost, "/review/"+judged.ID+"/verdict", `{"verdict": "same"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		items := decode(t, w)
+		require.Len(t, items, 1)
+		require.Equal(t, review.VerdictSame, items[0].Verdict)
+		require.NotNil(t, items[0].ReviewedAt)
+	})
+
+	t.Run("verdict errors", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			id     string
+			body   string
+			status int
+			code   string
+		}{
+			{name: "malformed json", id: pending.ID, body: `{"verdict": `, status: http.StatusBadRequest, code: CodeInvalidRequest},
+			{name: "wrong verdict", id: pending.ID, body: `{"verdict": "maybe"}`, status: http.StatusBadRequest, code: CodeInvalidRequest},
+			{name: "unknown item", id: "missing", body: `{"verdict": "same"}`, status: http.StatusNotFound, code: CodeNotFound},
+			{name: "already judged", id: judged.ID, body: `{"verdict": "different"}`, status: http.StatusConflict, code: CodeConflict},
+		}
+
+		for _, tt := range tests {
+			tt := tt
+			t.Run(tt.name, func(t *testing.T) {
+				w := send(http.MethodPost, "/review/"+tt.id+"/verdict", tt.body)
+				require.Equal(t, tt.status, w.Code)
+
+				var rsp ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+				require.Equal(t, tt.code, rsp.Code)
+			})
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := send(http.MethodGet, "/review/", "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		items := decode(t, w)
+		require.Len(t, items, 1)
+		require.Equal(t, pending.ID, items[0].ID)
+	})
+
+	t.Run("item", func(t *testing.T) {
+		w := send(http.MethodGet, "/review/"+pending.ID, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		items := decode(t, w)
+		require.Len(t, items, 1)
+		require.Equal(t, "pending", items[0].Target)
+
+		w = send(http.MethodGet, "/review/missing", "")
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		w := send(http.MethodGet, "/review/export", "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		items := decode(t, w)
+		require.Len(t, items, 1)
+		require.Equal(t, judged.ID, items[0].ID)
+	})
+
+	t.Run("csv export", func(t *testing.T) {
+		w := send(http.MethodGet, "/review/export?format=csv", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		require.Equal(t, []string{"id", "reference", "target", "similarity", "verdict", "created_at", "reviewed_at"}, records[0])
+		require.Equal(t, []string{judged.ID, "reference", "judged", "75.5", "same"}, records[1][:5])
+		require.Equal(t, judged.CreatedAt.Format(time.RFC3339), records[1][5])
+		require.NotEmpty(t, records[1][6])
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/review/", nil)
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	// review is granted explicitly, neither a plain key nor the shared secret has it
+	for _, key := range []string{"key", "secret"} {
+		key := key
+		t.Run("not granted to "+key, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/review/", nil)
+			r.Header.Set("X-API-Key", key)
+			w := httptest.NewRecorder()
+			server.Server.Handler.ServeHTTP(w, r)
+			require.Equal(t, http.StatusForbidden, w.Code)
+		})
+	}
+
+	t.Run("jwt", func(t *testing.T) {
+		exp := time.Now().Add(time.Hour).Unix()
+		tests := map[string]struct {
+			claims string
+			status int
+		}{
+			"without allowed features": {claims: fmt.Sprintf(`{"sub": "partner", "exp": %d}`, exp), status: http.StatusForbidden},
+			"review allowed":           {claims: fmt.Sprintf(`{"sub": "partner", "exp": %d, "allowed_features": ["review"]}`, exp), status: http.StatusOK},
+		}
+
+		for name, tt := range tests {
+			tt := tt
+			t.Run(name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, "/review/", nil)
+				r.Header.Set("Authorization", "Bearer "+hs256Token(tt.claims))
+				w := httptest.NewRecorder()
+				server.Server.Handler.ServeHTTP(w, r)
+				require.Equal(t, tt.status, w.Code)
+			})
+		}
+	})
+
+	t.Run("reviewer can't compare", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/v2/compare/", strings.NewReader(`{"urls": ["a", "b"]}`))
+		r.Header.Set("X-API-Key", "reviewer")
+		w := httptest.NewRecorder()
+		server.Server.Handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+)
+
+const (
+	MimeNDJSON      = "application/x-ndjson"
+	MimeEventStream = "text/event-stream"
+
+	EventTarget  = "target"
+	EventSummary = "summary"
+)
+
+// StreamEvent is a line of the ndjson stream, server-sent events carry the data only under the event name.
+type StreamEvent struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// TargetEvent is sent as soon as the target is compared, Index is its position in the targets.
+type TargetEvent struct {
+	Index int `json:"index"`
+	ImageResult
+}
+
+// SummaryEvent closes the stream, Error is set if the whole comparison failed.
+type SummaryEvent struct {
+	Reference ImageResult     `json:"reference"`
+	Gender    string          `json:"gender"`
+	Errors    []ErrorResponse `json:"errors"`
+	Error     *ErrorResponse  `json:"error,omitempty"`
+}
+
+// streamFormat returns the streaming media type accepted by the client, or an empty string if it wants a plain response.
+func streamFormat(r *http.Request) string {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+			if mediaType == MimeNDJSON || mediaType == MimeEventStream {
+				return mediaType
+			}
+		}
+	}
+
+	return ""
+}
+
+// streamComparison sends every target as soon as it is compared, then the summary.
+// The response is 200 OK once streaming starts, so the failures are reported by the summary.
+func (h *Handler) streamComparison(w http.ResponseWriter, r *http.Request, format, reference string, targets []string, options internalApp.Options) {
+	w.Header().Set("Content-Type", format)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	stream := eventStream{w: w, format: format}
+	stream.flush()
+
+	options.OnTarget = func(i int, target internalApp.ImageResult) {
+		event := TargetEvent{Index: i, ImageResult: newImageResults([]internalApp.ImageResult{target})[0]}
+		if err := stream.send(EventTarget, event); err != nil {
+			h.Logger.Error(err)
+		}
+	}
+
+	result := h.App.CompareImages(r.Context(), reference, targets, options)
+
+	rsp := newComparisonResponseV2(result)
+	for _, e := range rsp.Errors {
+		h.Logger.Error(e.Message)
+	}
+
+	summary := SummaryEvent{Reference: rsp.Reference, Gender: rsp.Gender, Errors: rsp.Errors}
+	if failure, ok := comparisonFailure(result); ok {
+		summary.Error = &failure
+	}
+
+	if err := stream.send(EventSummary, summary); err != nil {
+		h.Logger.Error(err)
+	}
+}
+
+type eventStream struct {
+	w      http.ResponseWriter
+	format string
+}
+
+func (s eventStream) send(event string, data interface{}) error {
+	var err error
+	if s.format == MimeEventStream {
+		var bytes []byte
+		if bytes, err = json.Marshal(data); err == nil {
+			_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, bytes)
+		}
+	} else {
+		err = json.NewEncoder(s.w).Encode(StreamEvent{Event: event, Data: data})
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to send %s event: %w", event, err)
+	}
+
+	s.flush()
+
+	return nil
+}
+
+func (s eventStream) flush() {
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
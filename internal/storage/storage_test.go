@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "state.json")
+
+	require.NoError(t, WriteFile(file, []byte(`{"a":1}`)))
+	require.NoError(t, WriteFile(file, []byte(`{}`)))
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, `{}`, string(content))
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	require.Error(t, WriteFile(filepath.Join(dir, "missing", "state.json"), []byte(`{}`)))
+}
+
+func TestNewID(t *testing.T) {
+	a, err := NewID()
+	require.NoError(t, err)
+	require.Len(t, a, 32)
+
+	b, err := NewID()
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+}
@@ -0,0 +1,385 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/spendmail/face_comparison/internal/storage"
+	"github.com/spendmail/face_comparison/internal/wrap"
+)
+
+const (
+	HeaderID        = "X-Webhook-Id"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+type Config interface {
+	GetWebhookSecret() string
+	GetWebhookOutboxFile() string
+	GetWebhookTimeout() time.Duration
+	GetWebhookMaxAttempts() int
+	GetWebhookBackoff() time.Duration
+	GetWebhookMaxBackoff() time.Duration
+	GetWebhookWorkers() int
+	GetWebhookAllowedNetworks() []string
+	GetWebhookAllowedDomains() []string
+	GetWebhookDeniedDomains() []string
+}
+
+type Logger interface {
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+var (
+	ErrNoSecret    = errors.New("webhook secret is not configured")
+	ErrOutboxRead  = errors.New("unable to read webhook outbox file")
+	ErrOutboxWrite = errors.New("unable to write webhook outbox file")
+	ErrDelivery    = errors.New("webhook delivery failed")
+)
+
+// Delivery is a payload waiting to be posted to its url, it keeps its id across the attempts
+// so the receiver is able to drop the duplicates.
+type Delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Outbox posts the payloads signed with the secret and retries the failed deliveries with exponential backoff,
+// until they're accepted or the attempts are over.
+// Up to workers deliveries are made at once, one per host, so a hanging receiver holds up its own deliveries only.
+// The pending deliveries are dumped to the file on every change, so they survive a restart.
+type Outbox struct {
+	logger      Logger
+	guard       *internalApp.Guard
+	client      *http.Client
+	secret      []byte
+	file        string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	workers     int
+
+	mu         sync.Mutex
+	deliveries []*Delivery
+	// hosts are being delivered to right now
+	hosts map[string]struct{}
+	wake  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewGuard keeps the callbacks away from internal addresses, by the webhook lists rather than the downloader ones,
+// so opening a network for the downloads doesn't open it for the callbacks.
+func NewGuard(config Config) (*internalApp.Guard, error) {
+	return internalApp.NewGuardFromLists(
+		config.GetWebhookAllowedNetworks(),
+		config.GetWebhookAllowedDomains(),
+		config.GetWebhookDeniedDomains(),
+	)
+}
+
+// New makes an outbox posting through the guard, every url and every address connected to is checked by it.
+func New(config Config, logger Logger, guard *internalApp.Guard) (*Outbox, error) {
+	timeout := config.GetWebhookTimeout()
+
+	o := &Outbox{
+		logger: logger,
+		guard:  guard,
+		client: &http.Client{
+			Transport: internalApp.NewTransport(guard, timeout, timeout),
+			Timeout:   timeout,
+			// redirects aren't followed, the receiver has to accept the payload itself
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		secret:      []byte(config.GetWebhookSecret()),
+		file:        config.GetWebhookOutboxFile(),
+		maxAttempts: config.GetWebhookMaxAttempts(),
+		backoff:     config.GetWebhookBackoff(),
+		maxBackoff:  config.GetWebhookMaxBackoff(),
+		workers:     config.GetWebhookWorkers(),
+		deliveries:  make([]*Delivery, 0),
+		hosts:       make(map[string]struct{}),
+		wake:        make(chan struct{}, 1),
+	}
+
+	if o.workers < 1 {
+		o.workers = 1
+	}
+
+	if o.maxAttempts < 1 {
+		o.maxAttempts = 1
+	}
+
+	if o.backoff <= 0 {
+		o.backoff = time.Second
+	}
+
+	if o.maxBackoff < o.backoff {
+		o.maxBackoff = o.backoff
+	}
+
+	if o.file == "" {
+		return o, nil
+	}
+
+	content, err := os.ReadFile(o.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, wrap.New(ErrOutboxRead, err)
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &o.deliveries); err != nil {
+			return nil, wrap.New(ErrOutboxRead, err)
+		}
+	}
+
+	return o, nil
+}
+
+// Enabled tells whether the payloads can be signed, nothing is accepted without the secret.
+func (o *Outbox) Enabled() bool {
+	return len(o.secret) > 0
+}
+
+// Enqueue stores the payload for delivery, the first attempt is made right away by Run.
+func (o *Outbox) Enqueue(url string, payload []byte) error {
+	if !o.Enabled() {
+		return ErrNoSecret
+	}
+
+	id, err := storage.NewID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	o.mu.Lock()
+	o.deliveries = append(o.deliveries, &Delivery{
+		ID:          id,
+		URL:         url,
+		Payload:     payload,
+		NextAttempt: now,
+		CreatedAt:   now,
+	})
+	err = o.dump()
+	o.mu.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return err
+}
+
+// Run delivers the due payloads until ctx is done, then waits for the attempts in progress.
+// The pending deliveries are kept in the file for the next start.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		o.deliver(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			o.wg.Wait()
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// deliver starts an attempt for every delivery due by now, unless its host is busy or all the workers are,
+// those are left for the next round. It doesn't wait for the attempts to finish.
+func (o *Outbox) deliver(ctx context.Context, now time.Time) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, d := range o.deliveries {
+		if len(o.hosts) >= o.workers {
+			return
+		}
+
+		host := deliveryHost(d.URL)
+		if _, busy := o.hosts[host]; busy || d.NextAttempt.After(now) {
+			continue
+		}
+
+		o.hosts[host] = struct{}{}
+		o.wg.Add(1)
+		go func(d Delivery) {
+			defer o.wg.Done()
+			o.attempt(ctx, d)
+		}(*d)
+	}
+}
+
+// attempt posts the delivery, then drops it or schedules a retry.
+func (o *Outbox) attempt(ctx context.Context, d Delivery) {
+	host := deliveryHost(d.URL)
+
+	err := o.post(ctx, d)
+	d.Attempts++
+
+	switch {
+	case err == nil:
+		o.logger.Info(fmt.Sprintf("webhook %s delivered to %s, attempt %d", d.ID, d.URL, d.Attempts))
+		o.update(host, d.ID, nil)
+	case ctx.Err() != nil:
+		// the attempt was interrupted by the shutdown, it doesn't count
+		o.mu.Lock()
+		delete(o.hosts, host)
+		o.mu.Unlock()
+	case d.Attempts >= o.maxAttempts:
+		o.logger.Error(fmt.Errorf("webhook %s to %s dropped after %d attempts: %w", d.ID, d.URL, d.Attempts, err))
+		o.update(host, d.ID, nil)
+	default:
+		d.NextAttempt = time.Now().Add(o.delay(d.Attempts))
+		o.logger.Warn(fmt.Sprintf("webhook %s to %s failed, attempt %d, retry at %s: %s",
+			d.ID, d.URL, d.Attempts, d.NextAttempt.Format(time.RFC3339), err))
+		o.update(host, d.ID, &d)
+	}
+}
+
+// update frees the host and drops the delivery, or replaces it with the retried one if set, then dumps the outbox.
+func (o *Outbox) update(host, id string, retry *Delivery) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.hosts, host)
+
+	for i, d := range o.deliveries {
+		if d.ID != id {
+			continue
+		}
+
+		if retry != nil {
+			o.deliveries[i] = retry
+		} else {
+			o.deliveries = append(o.deliveries[:i], o.deliveries[i+1:]...)
+		}
+
+		break
+	}
+
+	if err := o.dump(); err != nil {
+		o.logger.Error(err)
+	}
+}
+
+// deliveryHost is the host the deliveries are queued by, the url itself if it can't be parsed.
+func deliveryHost(deliveryURL string) string {
+	u, err := url.Parse(deliveryURL)
+	if err != nil || u.Host == "" {
+		return deliveryURL
+	}
+
+	return u.Host
+}
+
+// delay doubles the backoff on every failed attempt up to the max backoff.
+func (o *Outbox) delay(attempts int) time.Duration {
+	delay := o.backoff
+	for i := 1; i < attempts && delay < o.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > o.maxBackoff {
+		delay = o.maxBackoff
+	}
+
+	return delay
+}
+
+func (o *Outbox) post(ctx context.Context, d Delivery) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return wrap.New(ErrDelivery, err)
+	}
+
+	if err := o.guard.CheckURL(req.URL); err != nil {
+		return wrap.New(ErrDelivery, err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, d.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(o.secret, timestamp, d.Payload))
+
+	rsp, err := o.client.Do(req)
+	if err != nil {
+		return wrap.New(ErrDelivery, err)
+	}
+	defer rsp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(rsp.Body, 64*1024))
+
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("%w: status %d", ErrDelivery, rsp.StatusCode)
+	}
+
+	return nil
+}
+
+// dump writes the deliveries to the outbox file, the caller holds the lock.
+func (o *Outbox) dump() error {
+	if o.file == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(o.deliveries)
+	if err != nil {
+		return wrap.New(ErrOutboxWrite, err)
+	}
+
+	if err := storage.WriteFile(o.file, content); err != nil {
+		return wrap.New(ErrOutboxWrite, err)
+	}
+
+	return nil
+}
+
+// Sign returns the signature header value of the payload sent at the unix timestamp,
+// it is the hex encoded HMAC-SHA256 of the timestamp and the payload joined by a dot.
+func Sign(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
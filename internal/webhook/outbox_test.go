@@ -0,0 +1,271 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	internalApp "github.com/spendmail/face_comparison/internal/app"
+	"github.com/stretchr/testify/require"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Info(args ...interface{})  {}
+func (nopLogger) Warn(args ...interface{})  {}
+func (nopLogger) Error(args ...interface{}) {}
+
+type fakeConfig struct {
+	secret      string
+	file        string
+	maxAttempts int
+	networks    []string
+}
+
+func (c fakeConfig) GetWebhookSecret() string            { return c.secret }
+func (c fakeConfig) GetWebhookOutboxFile() string        { return c.file }
+func (fakeConfig) GetWebhookTimeout() time.Duration      { return time.Second }
+func (c fakeConfig) GetWebhookMaxAttempts() int          { return c.maxAttempts }
+func (fakeConfig) GetWebhookBackoff() time.Duration      { return time.Second }
+func (fakeConfig) GetWebhookMaxBackoff() time.Duration   { return 4 * time.Second }
+func (fakeConfig) GetWebhookWorkers() int                { return 2 }
+func (c fakeConfig) GetWebhookAllowedNetworks() []string { return c.networks }
+func (fakeConfig) GetWebhookAllowedDomains() []string    { return nil }
+func (fakeConfig) GetWebhookDeniedDomains() []string     { return []string{"internal.example"} }
+
+// newGuard allows the networks of the test receivers only.
+func newGuard(t *testing.T, allowed ...string) *internalApp.Guard {
+	t.Helper()
+
+	guard, err := NewGuard(fakeConfig{networks: allowed})
+	require.NoError(t, err)
+
+	return guard
+}
+
+// receiver answers with the statuses in turn and keeps the requests it got.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+	w.WriteHeader(status)
+}
+
+// deliver makes the due attempts and waits for them.
+func deliver(outbox *Outbox, now time.Time) {
+	outbox.deliver(context.Background(), now)
+	outbox.wg.Wait()
+}
+
+func TestOutbox(t *testing.T) {
+	guard := newGuard(t, "127.0.0.1", "::1")
+
+	t.Run("signed delivery", func(t *testing.T) {
+		rcv := &receiver{}
+		server := httptest.NewServer(rcv)
+		defer server.Close()
+
+		outbox, err := New(fakeConfig{secret: "secret", maxAttempts: 3}, nopLogger{}, guard)
+		require.NoError(t, err)
+		require.NoError(t, outbox.Enqueue(server.URL, []byte(`{"id":"job"}`)))
+
+		deliver(outbox, time.Now())
+
+		require.Len(t, rcv.requests, 1)
+		require.Equal(t, `{"id":"job"}`, rcv.bodies[0])
+
+		header := rcv.requests[0].Header
+		require.NotEmpty(t, header.Get(HeaderID))
+		require.Equal(t, Sign([]byte("secret"), header.Get(HeaderTimestamp), []byte(`{"id":"job"}`)), header.Get(HeaderSignature))
+		require.Empty(t, outbox.deliveries)
+	})
+
+	t.Run("retries with backoff", func(t *testing.T) {
+		rcv := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+		server := httptest.NewServer(rcv)
+		defer server.Close()
+
+		outbox, err := New(fakeConfig{secret: "secret", maxAttempts: 3}, nopLogger{}, guard)
+		require.NoError(t, err)
+		require.NoError(t, outbox.Enqueue(server.URL, []byte(`{}`)))
+
+		now := time.Now()
+		deliver(outbox, now)
+		require.Len(t, outbox.deliveries, 1)
+		require.Equal(t, 1, outbox.deliveries[0].Attempts)
+
+		// not due yet
+		deliver(outbox, now)
+		require.Len(t, rcv.requests, 1)
+
+		deliver(outbox, now.Add(2*time.Second))
+		require.Equal(t, 2, outbox.deliveries[0].Attempts)
+
+		deliver(outbox, now.Add(time.Minute))
+		require.Empty(t, outbox.deliveries)
+		require.Len(t, rcv.requests, 3)
+
+		// the id is kept across the attempts
+		require.Equal(t, rcv.requests[0].Header.Get(HeaderID), rcv.requests[2].Header.Get(HeaderID))
+	})
+
+	t.Run("dropped after max attempts", func(t *testing.T) {
+		rcv := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusInternalServerError}}
+		server := httptest.NewServer(rcv)
+		defer server.Close()
+
+		outbox, err := New(fakeConfig{secret: "secret", maxAttempts: 2}, nopLogger{}, guard)
+		require.NoError(t, err)
+		require.NoError(t, outbox.Enqueue(server.URL, []byte(`{}`)))
+
+		deliver(outbox, time.Now())
+		deliver(outbox, time.Now().Add(time.Minute))
+
+		require.Len(t, rcv.requests, 2)
+		require.Empty(t, outbox.deliveries)
+	})
+
+	t.Run("survives restart", func(t *testing.T) {
+		rcv := &receiver{statuses: []int{http.StatusServiceUnavailable}}
+		server := httptest.NewServer(rcv)
+		defer server.Close()
+
+		config := fakeConfig{secret: "secret", file: filepath.Join(t.TempDir(), "outbox.json"), maxAttempts: 3}
+
+		outbox, err := New(config, nopLogger{}, guard)
+		require.NoError(t, err)
+		require.NoError(t, outbox.Enqueue(server.URL, []byte(`{}`)))
+		deliver(outbox, time.Now())
+
+		restarted, err := New(config, nopLogger{}, guard)
+		require.NoError(t, err)
+		require.Len(t, restarted.deliveries, 1)
+		require.Equal(t, 1, restarted.deliveries[0].Attempts)
+
+		deliver(restarted, time.Now().Add(time.Minute))
+		require.Len(t, rcv.requests, 2)
+
+		restarted, err = New(config, nopLogger{}, guard)
+		require.NoError(t, err)
+		require.Empty(t, restarted.deliveries)
+	})
+
+	t.Run("no secret", func(t *testing.T) {
+		outbox, err := New(fakeConfig{}, nopLogger{}, guard)
+		require.NoError(t, err)
+		require.False(t, outbox.Enabled())
+		require.ErrorIs(t, outbox.Enqueue("http://callback", []byte(`{}`)), ErrNoSecret)
+	})
+}
+
+func TestOutboxHangingHost(t *testing.T) {
+	release := make(chan struct{})
+	hanging := 0
+	mu := sync.Mutex{}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hanging++
+		mu.Unlock()
+		<-release
+	}))
+	defer slow.Close()
+
+	rcv := &receiver{}
+	fast := httptest.NewServer(rcv)
+	defer fast.Close()
+
+	outbox, err := New(fakeConfig{secret: "secret", maxAttempts: 3}, nopLogger{}, newGuard(t, "127.0.0.1", "::1"))
+	require.NoError(t, err)
+
+	require.NoError(t, outbox.Enqueue(slow.URL, []byte(`{}`)))
+	require.NoError(t, outbox.Enqueue(slow.URL, []byte(`{}`)))
+	require.NoError(t, outbox.Enqueue(fast.URL, []byte(`{}`)))
+
+	outbox.deliver(context.Background(), time.Now())
+
+	// the other host is delivered to while the slow one hangs
+	require.Eventually(t, func() bool {
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		return len(rcv.requests) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the host gets a single delivery at a time
+	outbox.deliver(context.Background(), time.Now())
+	mu.Lock()
+	require.Equal(t, 1, hanging)
+	mu.Unlock()
+
+	close(release)
+	outbox.wg.Wait()
+
+	deliver(outbox, time.Now())
+	require.Empty(t, outbox.deliveries)
+	require.Equal(t, 2, hanging)
+}
+
+func TestOutboxGuard(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("internal addresses", func(t *testing.T) {
+		rcv := &receiver{}
+		server := httptest.NewServer(rcv)
+		defer server.Close()
+
+		outbox, err := New(fakeConfig{secret: "secret", maxAttempts: 1}, nopLogger{}, newGuard(t))
+		require.NoError(t, err)
+
+		for _, url := range []string{server.URL, "http://169.254.169.254/latest/meta-data/", "https://hooks.internal.example/", "file:///etc/passwd"} {
+			d := Delivery{ID: "id", URL: url, Payload: []byte(`{}`)}
+			require.ErrorIs(t, outbox.post(ctx, d), internalApp.ErrBlocked, url)
+		}
+		require.Empty(t, rcv.requests)
+	})
+
+	t.Run("redirects", func(t *testing.T) {
+		rcv := &receiver{}
+		target := httptest.NewServer(rcv)
+		defer target.Close()
+
+		server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+		defer server.Close()
+
+		outbox, err := New(fakeConfig{secret: "secret", maxAttempts: 1}, nopLogger{}, newGuard(t, "127.0.0.1", "::1"))
+		require.NoError(t, err)
+
+		require.ErrorIs(t, outbox.post(ctx, Delivery{ID: "id", URL: server.URL, Payload: []byte(`{}`)}), ErrDelivery)
+		require.Empty(t, rcv.requests)
+	})
+}
+
+func TestOutboxDelay(t *testing.T) {
+	outbox, err := New(fakeConfig{secret: "secret"}, nopLogger{}, newGuard(t))
+	require.NoError(t, err)
+
+	require.Equal(t, time.Second, outbox.delay(1))
+	require.Equal(t, 2*time.Second, outbox.delay(2))
+	require.Equal(t, 4*time.Second, outbox.delay(3))
+	require.Equal(t, 4*time.Second, outbox.delay(10))
+}
@@ -0,0 +1,29 @@
+package wrap
+
+// Error keeps the cause of a failure along with its kind.
+// It matches the kind with errors.Is, the cause stays reachable with errors.Is and errors.As as well,
+// e.g. a timed out download is both app.ErrTimeout and a net.Error.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func New(kind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
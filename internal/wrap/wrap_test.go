@@ -0,0 +1,24 @@
+package wrap
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestError(t *testing.T) {
+	errRead := errors.New("unable to read")
+
+	_, cause := os.ReadFile("/very/wrong/path")
+	err := New(errRead, cause)
+
+	require.Equal(t, "unable to read: "+cause.Error(), err.Error())
+	require.ErrorIs(t, err, errRead)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	var pathErr *fs.PathError
+	require.ErrorAs(t, err, &pathErr)
+}